@@ -2,3 +2,5 @@
 
 GOPATH=`pwd` go build -o ./bin/painttyServer ./src/server/painttyServer.go
 GOPATH=`pwd` go build -o ./bin/watchDog ./src/watchDog/watchDog.go
+GOPATH=`pwd` go build -o ./bin/loadTest ./src/loadTest/loadTest.go
+GOPATH=`pwd` go build -o ./bin/painttyAdmin ./src/painttyAdmin
@@ -0,0 +1,421 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"math/rand"
+	"net"
+	"server/pkg/Client"
+	"server/pkg/RoomManager"
+	"server/pkg/Socket"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// loadTest opens lots of simulated painters against a running painttyServer,
+// and reports how fast their strokes and messages travel.
+
+var (
+	managerAddr     = ""
+	roomPrefix      = ""
+	roomPassword    = ""
+	roomCount       = 1
+	clientCount     = 8
+	maxLoad         = 8
+	canvasWidth     = 720
+	canvasHeight    = 480
+	strokeRate      = 2.0
+	chatRate        = 0.2
+	pointsPerStroke = 20
+	fetchArchive    = true
+	duration        = time.Minute
+	reconnectEvery  = time.Duration(0)
+)
+
+func init() {
+	flag.StringVar(&managerAddr, "manager", "localhost:7777", "address of RoomManager")
+	flag.StringVar(&roomPrefix, "room", "loadtest", "rooms are named as room-0, room-1...; existing ones are joined")
+	flag.StringVar(&roomPassword, "password", "", "password of rooms")
+	flag.IntVar(&roomCount, "rooms", 1, "how many rooms to use")
+	flag.IntVar(&clientCount, "clients", 8, "how many painters in each room")
+	flag.IntVar(&maxLoad, "maxload", 8, "max load of rooms created")
+	flag.IntVar(&canvasWidth, "width", 720, "canvas width of rooms created")
+	flag.IntVar(&canvasHeight, "height", 480, "canvas height of rooms created")
+	flag.Float64Var(&strokeRate, "strokes", 2.0, "strokes per second of each painter, 0 disables")
+	flag.Float64Var(&chatRate, "chats", 0.2, "messages per second of each painter, 0 disables")
+	flag.IntVar(&pointsPerStroke, "points", 20, "points in each stroke")
+	flag.BoolVar(&fetchArchive, "archive", true, "request archive after login")
+	flag.DurationVar(&duration, "duration", time.Minute, "how long the test runs")
+	flag.DurationVar(&reconnectEvery, "reconnect", 0, "painters reconnect this often, 0 disables")
+}
+
+type Stats struct {
+	bytesSent      int64
+	bytesReceived  int64
+	strokesSent    int64
+	messagesSent   int64
+	packsReceived  int64
+	reconnects     int64
+	protocolErrors int64
+	latencies      []time.Duration
+	errors         map[string]int
+	locker         sync.Mutex
+}
+
+func (s *Stats) addLatency(latency time.Duration) {
+	s.locker.Lock()
+	defer s.locker.Unlock()
+	s.latencies = append(s.latencies, latency)
+}
+
+func (s *Stats) protocolError(reason string) {
+	atomic.AddInt64(&s.protocolErrors, 1)
+	s.locker.Lock()
+	defer s.locker.Unlock()
+	s.errors[reason]++
+}
+
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+	var index = int(float64(len(sorted)-1) * p)
+	return sorted[index]
+}
+
+func (s *Stats) report(elapsed time.Duration) {
+	s.locker.Lock()
+	defer s.locker.Unlock()
+	sort.Slice(s.latencies, func(i, j int) bool {
+		return s.latencies[i] < s.latencies[j]
+	})
+	var seconds = elapsed.Seconds()
+	fmt.Printf("duration:        %v\n", elapsed)
+	fmt.Printf("painters:        %d in %d room(s)\n", clientCount*roomCount, roomCount)
+	fmt.Printf("strokes sent:    %d\n", atomic.LoadInt64(&s.strokesSent))
+	fmt.Printf("messages sent:   %d\n", atomic.LoadInt64(&s.messagesSent))
+	fmt.Printf("packs received:  %d\n", atomic.LoadInt64(&s.packsReceived))
+	fmt.Printf("bytes sent:      %d (%.1f KB/s)\n", atomic.LoadInt64(&s.bytesSent),
+		float64(atomic.LoadInt64(&s.bytesSent))/1024/seconds)
+	fmt.Printf("bytes received:  %d (%.1f KB/s)\n", atomic.LoadInt64(&s.bytesReceived),
+		float64(atomic.LoadInt64(&s.bytesReceived))/1024/seconds)
+	fmt.Printf("reconnects:      %d\n", atomic.LoadInt64(&s.reconnects))
+	fmt.Printf("latency samples: %d\n", len(s.latencies))
+	if len(s.latencies) > 0 {
+		fmt.Printf("latency p50:     %v\n", percentile(s.latencies, 0.5))
+		fmt.Printf("latency p90:     %v\n", percentile(s.latencies, 0.9))
+		fmt.Printf("latency p99:     %v\n", percentile(s.latencies, 0.99))
+		fmt.Printf("latency max:     %v\n", s.latencies[len(s.latencies)-1])
+	}
+	fmt.Printf("protocol errors: %d\n", atomic.LoadInt64(&s.protocolErrors))
+	for reason, count := range s.errors {
+		fmt.Printf("    %s: %d\n", reason, count)
+	}
+}
+
+// countingConn counts bytes on wire.
+type countingConn struct {
+	net.Conn
+	stats *Stats
+}
+
+func (c *countingConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	atomic.AddInt64(&c.stats.bytesReceived, int64(n))
+	return n, err
+}
+
+func (c *countingConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	atomic.AddInt64(&c.stats.bytesSent, int64(n))
+	return n, err
+}
+
+type Target struct {
+	Name string
+	Addr string
+}
+
+func prepareRooms() ([]Target, error) {
+	manager, err := Client.DialManager(managerAddr)
+	if err != nil {
+		return nil, err
+	}
+	defer manager.Close()
+	host, _, err := net.SplitHostPort(managerAddr)
+	if err != nil {
+		return nil, err
+	}
+
+	list, err := manager.RoomList()
+	if err != nil {
+		return nil, err
+	}
+	var ports = make(map[string]uint16)
+	for _, room := range list.RoomList {
+		ports[room.Name] = room.Port
+	}
+
+	var targets = make([]Target, 0, roomCount)
+	for i := 0; i < roomCount; i++ {
+		var name = roomPrefix + "-" + strconv.Itoa(i)
+		port, ok := ports[name]
+		if !ok {
+			resp, err := manager.NewRoom(RoomManager.NewRoomInfoForRequest{
+				Name:     name,
+				MaxLoad:  maxLoad,
+				Password: roomPassword,
+				Size: RoomManager.NewRoomSize{
+					Width:  int64(canvasWidth),
+					Height: int64(canvasHeight),
+				},
+			})
+			if err != nil {
+				return nil, err
+			}
+			if !resp.Result {
+				return nil, fmt.Errorf("cannot create room %s, errcode %d", name, resp.ErrCode)
+			}
+			port = resp.Info.Port
+		}
+		targets = append(targets, Target{
+			Name: name,
+			Addr: net.JoinHostPort(host, strconv.Itoa(int(port))),
+		})
+	}
+	return targets, nil
+}
+
+type Point struct {
+	X        int     `json:"x"`
+	Y        int     `json:"y"`
+	Pressure float64 `json:"pressure"`
+}
+
+type Color struct {
+	Red   int `json:"red"`
+	Green int `json:"green"`
+	Blue  int `json:"blue"`
+}
+
+type Brush struct {
+	Width int    `json:"width"`
+	Color Color  `json:"color"`
+	Name  string `json:"name"`
+}
+
+type BlockAction struct {
+	Action string  `json:"action"`
+	Layer  string  `json:"layer"`
+	UserId string  `json:"userid"`
+	Name   string  `json:"name"`
+	Block  []Point `json:"block"`
+	Brush  Brush   `json:"brush"`
+	Sent   int64   `json:"loadtest_sent"`
+}
+
+type TextMessage struct {
+	From    string `json:"from"`
+	To      string `json:"to"`
+	Content string `json:"content"`
+	Sent    int64  `json:"loadtest_sent"`
+}
+
+type Painter struct {
+	id     int
+	name   string
+	target Target
+	stats  *Stats
+	random *rand.Rand
+}
+
+func (p *Painter) stroke(clientId string) []byte {
+	var x = p.random.Intn(canvasWidth)
+	var y = p.random.Intn(canvasHeight)
+	var points = make([]Point, 0, pointsPerStroke)
+	for i := 0; i < pointsPerStroke; i++ {
+		x += p.random.Intn(11) - 5
+		y += p.random.Intn(11) - 5
+		points = append(points, Point{
+			X:        x,
+			Y:        y,
+			Pressure: p.random.Float64(),
+		})
+	}
+	raw, _ := json.Marshal(BlockAction{
+		Action: "block",
+		Layer:  "layer" + strconv.Itoa(p.random.Intn(2)),
+		UserId: clientId,
+		Name:   p.name,
+		Block:  points,
+		Brush: Brush{
+			Width: 1 + p.random.Intn(20),
+			Color: Color{
+				Red:   p.random.Intn(256),
+				Green: p.random.Intn(256),
+				Blue:  p.random.Intn(256),
+			},
+			Name: "Brush",
+		},
+		Sent: time.Now().UnixNano(),
+	})
+	return raw
+}
+
+func (p *Painter) message() []byte {
+	raw, _ := json.Marshal(TextMessage{
+		From:    p.name,
+		Content: "hello from " + p.name,
+		Sent:    time.Now().UnixNano(),
+	})
+	return raw
+}
+
+func ticker(rate float64) (<-chan time.Time, func()) {
+	if rate <= 0 {
+		return nil, func() {}
+	}
+	var t = time.NewTicker(time.Duration(float64(time.Second) / rate))
+	return t.C, t.Stop
+}
+
+// measure records latency of packs sent by any painter after since.
+func (p *Painter) measure(raw []byte, since int64) {
+	atomic.AddInt64(&p.stats.packsReceived, 1)
+	var stamp struct {
+		Sent int64 `json:"loadtest_sent"`
+	}
+	if err := json.Unmarshal(raw, &stamp); err != nil {
+		p.stats.protocolError("undecodable pack")
+		return
+	}
+	if stamp.Sent >= since {
+		p.stats.addLatency(time.Duration(time.Now().UnixNano() - stamp.Sent))
+	}
+}
+
+// session lasts until deadline, or the time to reconnect.
+func (p *Painter) session(deadline time.Time) {
+	conn, err := net.DialTimeout("tcp", p.target.Addr, Client.DEFAULT_TIMEOUT)
+	if err != nil {
+		p.stats.protocolError("dial: " + err.Error())
+		time.Sleep(time.Second)
+		return
+	}
+	var room = Client.NewRoomClient(Socket.MakeSocketClient(&countingConn{conn, p.stats}))
+	defer room.Close()
+
+	var disconnected = make(chan bool)
+	room.OnDisconnect(func() {
+		close(disconnected)
+	})
+	var since = time.Now().UnixNano()
+	room.OnData(func(raw []byte) {
+		p.measure(raw, since)
+	})
+	room.OnMessage(func(raw []byte) {
+		p.measure(raw, since)
+	})
+	room.OnKick(func() {
+		p.stats.protocolError("kicked")
+	})
+	room.OnAction("disconnect", func(_ []byte) {
+		p.stats.protocolError("disconnected for falling behind")
+	})
+
+	resp, err := room.Login(p.name, roomPassword, p.target.Name)
+	if err != nil {
+		p.stats.protocolError("login: " + err.Error())
+		return
+	}
+	if !resp.Result {
+		p.stats.protocolError("login errcode " + strconv.Itoa(int(resp.ErrCode)))
+		time.Sleep(time.Second)
+		return
+	}
+	if fetchArchive {
+		if _, err := room.Archive(0, 0); err != nil {
+			p.stats.protocolError("archive: " + err.Error())
+			return
+		}
+	}
+
+	var end = deadline
+	if reconnectEvery > 0 && time.Now().Add(reconnectEvery).Before(deadline) {
+		end = time.Now().Add(reconnectEvery)
+	}
+	strokes, stopStrokes := ticker(strokeRate)
+	defer stopStrokes()
+	chats, stopChats := ticker(chatRate)
+	defer stopChats()
+	var timer = time.NewTimer(time.Until(end))
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-strokes:
+			if err := room.SendData(p.stroke(room.ClientId())); err != nil {
+				p.stats.protocolError("send data: " + err.Error())
+				return
+			}
+			atomic.AddInt64(&p.stats.strokesSent, 1)
+		case <-chats:
+			if err := room.SendMessage(p.message()); err != nil {
+				p.stats.protocolError("send message: " + err.Error())
+				return
+			}
+			atomic.AddInt64(&p.stats.messagesSent, 1)
+		case <-disconnected:
+			p.stats.protocolError("disconnected by server")
+			return
+		case <-timer.C:
+			return
+		}
+	}
+}
+
+func (p *Painter) run(deadline time.Time, wg *sync.WaitGroup) {
+	defer wg.Done()
+	for first := true; time.Now().Before(deadline); first = false {
+		if !first {
+			atomic.AddInt64(&p.stats.reconnects, 1)
+		}
+		p.session(deadline)
+	}
+}
+
+func main() {
+	flag.Parse()
+	targets, err := prepareRooms()
+	if err != nil {
+		log.Fatalln("cannot prepare rooms:", err)
+	}
+
+	var stats = &Stats{
+		errors: make(map[string]int),
+	}
+	var start = time.Now()
+	var deadline = start.Add(duration)
+	var wg sync.WaitGroup
+	for i, target := range targets {
+		for j := 0; j < clientCount; j++ {
+			var id = i*clientCount + j
+			var painter = &Painter{
+				id:     id,
+				name:   "painter" + strconv.Itoa(id),
+				target: target,
+				stats:  stats,
+				random: rand.New(rand.NewSource(time.Now().UnixNano() + int64(id))),
+			}
+			wg.Add(1)
+			go painter.run(deadline, &wg)
+		}
+	}
+	wg.Wait()
+	stats.report(time.Since(start))
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"server/pkg/History"
+	"strings"
+)
+
+var errBroken = errors.New("some history is broken")
+
+// histories finds every history in dataDir, both stores and legacy .data
+// files.
+func histories(dataDir string) ([]string, error) {
+	infos, err := ioutil.ReadDir(dataDir)
+	if err != nil {
+		return nil, err
+	}
+	var result = make([]string, 0)
+	for _, info := range infos {
+		var name = filepath.Join(dataDir, info.Name())
+		if info.IsDir() {
+			if strings.HasSuffix(info.Name(), History.MIGRATING_SUFFIX) {
+				continue // left by an interrupted import, and redone on next load
+			}
+			if _, err := os.Stat(filepath.Join(name, History.INDEX_FILE_NAME)); err == nil {
+				result = append(result, name)
+			}
+		} else if strings.HasSuffix(info.Name(), ".data") {
+			result = append(result, name)
+		}
+	}
+	return result, nil
+}
+
+func checkHistory(name string, repair bool) (History.Validation, error) {
+	info, err := os.Stat(name)
+	if err != nil {
+		return History.Validation{}, err
+	}
+	if !info.IsDir() {
+		if repair {
+			return History.RepairFile(name)
+		}
+		return History.ValidateFile(name)
+	}
+	if repair {
+		store, err := History.Open(name, History.DEFAULT_SEGMENT_SIZE)
+		if err != nil {
+			return History.Validation{}, err
+		}
+		defer store.Close()
+		return store.Repair()
+	}
+	store, err := History.OpenReadOnly(name)
+	if err != nil {
+		return History.Validation{}, err
+	}
+	defer store.Close()
+	return store.Validate(), nil
+}
+
+func runCheck(args []string) error {
+	var flags = flag.NewFlagSet("check", flag.ExitOnError)
+	var dataDir = flags.String("data_dir", "./data/data", "data_dir of server")
+	var repair = flags.Bool("repair", false, "truncate broken history back to the last complete pack")
+	flags.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: painttyAdmin check [-data_dir dir] [-repair] [history...]")
+		fmt.Fprintln(os.Stderr, "history is a signature, or a path; all in data_dir by default")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	var names = flags.Args()
+	if len(names) == 0 {
+		var err error
+		if names, err = histories(*dataDir); err != nil {
+			return err
+		}
+	}
+
+	var broken = false
+	for _, name := range names {
+		if _, err := os.Stat(name); os.IsNotExist(err) {
+			name = filepath.Join(*dataDir, name)
+		}
+		v, err := checkHistory(name, *repair)
+		if err != nil {
+			fmt.Printf("%s: %v\n", name, err)
+			broken = true
+			continue
+		}
+		if !v.Broken() {
+			fmt.Printf("%s: ok, %d packs, %d bytes\n", name, v.Packs, v.Size)
+			continue
+		}
+		var action = "repaired"
+		if !*repair {
+			action = "broken"
+			broken = true
+		}
+		fmt.Printf("%s: %s, %d packs, %d of %d bytes complete, %d packs unindexed\n",
+			name, action, v.Packs, v.ValidSize, v.Size, v.Unindexed)
+	}
+	if broken {
+		return errBroken
+	}
+	return nil
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"image"
+	"os"
+	"path/filepath"
+	"server/pkg/Canvas"
+	"server/pkg/History"
+	"server/pkg/RoomManager"
+	"strings"
+)
+
+var (
+	errUnknownSize = errors.New("canvas size is unknown, use -width and -height")
+	errFailed      = errors.New("some history cannot be rendered")
+)
+
+// roomSizes reads canvas size of rooms in db at dbDir, by signature. Size
+// is guessed from history of rooms not found.
+func roomSizes(dbDir string) map[string]image.Point {
+	var sizes = make(map[string]image.Point)
+	rooms, err := RoomManager.LoadRooms(dbDir)
+	if err != nil {
+		fmt.Printf("cannot read rooms in %s: %v\n", dbDir, err)
+		return sizes
+	}
+	for signature, info := range rooms {
+		sizes[signature] = image.Pt(int(info.Options.Width), int(info.Options.Height))
+	}
+	return sizes
+}
+
+// sizeOf is width and height if given, or size of room of history name.
+func sizeOf(sizes map[string]image.Point, name string, width, height int) (int, int) {
+	if width > 0 && height > 0 {
+		return width, height
+	}
+	if size, ok := sizes[strings.TrimSuffix(filepath.Base(name), ".data")]; ok {
+		return size.X, size.Y
+	}
+	return width, height
+}
+
+// renderHistory renders a store, or a legacy .data file. width and height
+// are guessed from layer images if they're 0.
+func renderHistory(name string, width, height int) (*Canvas.Canvas, error) {
+	info, err := os.Stat(name)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		if width <= 0 || height <= 0 {
+			return nil, errUnknownSize
+		}
+		file, err := os.Open(name)
+		if err != nil {
+			return nil, err
+		}
+		defer file.Close()
+		var canvas = Canvas.NewCanvas(width, height)
+		err = History.ReadFrames(bufio.NewReader(file), func(frame []byte) error {
+			// like clients, skip what cannot be rendered
+			canvas.ApplyFrame(frame)
+			return nil
+		})
+		return canvas, err
+	}
+	store, err := History.OpenReadOnly(name)
+	if err != nil {
+		return nil, err
+	}
+	defer store.Close()
+	if width <= 0 || height <= 0 {
+		var ok bool
+		if width, height, ok = Canvas.SizeOf(store); !ok {
+			return nil, errUnknownSize
+		}
+	}
+	canvas, _, err := Canvas.Render(store, width, height)
+	return canvas, err
+}
+
+func exportCanvas(canvas *Canvas.Canvas, format, name string) error {
+	file, err := os.Create(name)
+	if err != nil {
+		return err
+	}
+	err = canvas.Export(format, file)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+func runExport(args []string) error {
+	var flags = flag.NewFlagSet("export", flag.ExitOnError)
+	var dataDir = flags.String("data_dir", "./data/data", "data_dir of server")
+	var outDir = flags.String("out", "", "where to put exported files, data_dir/exports by default")
+	var formats = flags.String("format", "png,ora", "comma separated formats, png and ora")
+	var dbDir = flags.String("db_dir", "./data/db", "db_dir of server, where canvas size of rooms is")
+	var width = flags.Int("width", 0, "canvas width, from db_dir or history by default")
+	var height = flags.Int("height", 0, "canvas height, from db_dir or history by default")
+	flags.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: painttyAdmin export [-data_dir dir] [-db_dir dir] [-out dir] [-format png,ora] [-width w -height h] [history...]")
+		fmt.Fprintln(os.Stderr, "history is a signature, or a path; all in data_dir by default")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if *outDir == "" {
+		*outDir = filepath.Join(*dataDir, "exports")
+	}
+	for _, format := range strings.Split(*formats, ",") {
+		if format != Canvas.FORMAT_PNG && format != Canvas.FORMAT_ORA {
+			return Canvas.ErrUnknownFormat
+		}
+	}
+
+	var names = flags.Args()
+	if len(names) == 0 {
+		var err error
+		if names, err = histories(*dataDir); err != nil {
+			return err
+		}
+	}
+	if err := os.MkdirAll(*outDir, 0755); err != nil {
+		return err
+	}
+
+	var sizes = roomSizes(*dbDir)
+	var failed error
+	for _, name := range names {
+		if _, err := os.Stat(name); os.IsNotExist(err) {
+			name = filepath.Join(*dataDir, name)
+		}
+		width, height := sizeOf(sizes, name, *width, *height)
+		canvas, err := renderHistory(name, width, height)
+		if err != nil {
+			fmt.Printf("%s: %v\n", name, err)
+			failed = errFailed
+			continue
+		}
+		var base = strings.TrimSuffix(filepath.Base(name), ".data")
+		for _, format := range strings.Split(*formats, ",") {
+			var out = filepath.Join(*outDir, base+"."+format)
+			if err := exportCanvas(canvas, format, out); err != nil {
+				fmt.Printf("%s: %v\n", name, err)
+				failed = errFailed
+				continue
+			}
+			fmt.Printf("%s: exported to %s\n", name, out)
+		}
+	}
+	return failed
+}
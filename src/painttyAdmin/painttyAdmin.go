@@ -0,0 +1,57 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+)
+
+// painttyAdmin works on data_dir of a stopped painttyServer.
+
+type Command struct {
+	Usage string
+	Run   func(args []string) error
+}
+
+var commands = map[string]Command{
+	"check": {
+		Usage: "check history of rooms, and repair them with -repair",
+		Run:   runCheck,
+	},
+	"export": {
+		Usage: "render history of rooms to PNG and OpenRaster files",
+		Run:   runExport,
+	},
+	"timelapse": {
+		Usage: "replay history of a room into PNG frames or an animated GIF",
+		Run:   runTimelapse,
+	},
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "usage: painttyAdmin <command> [arguments]")
+	fmt.Fprintln(os.Stderr, "commands:")
+	var names = make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(os.Stderr, "    %-10s %s\n", name, commands[name].Usage)
+	}
+	os.Exit(2)
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+	}
+	command, ok := commands[os.Args[1]]
+	if !ok {
+		usage()
+	}
+	if err := command.Run(os.Args[2:]); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
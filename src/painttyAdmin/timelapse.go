@@ -0,0 +1,185 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"image"
+	"image/color/palette"
+	"image/draw"
+	"image/gif"
+	"image/png"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"server/pkg/Canvas"
+	"server/pkg/History"
+	"strings"
+	"time"
+)
+
+// openHistory opens a store read-only. A legacy .data file is migrated into
+// a temporary store first, which cleanup removes, and the file is left as is.
+func openHistory(name string) (store *History.Store, cleanup func(), err error) {
+	info, err := os.Stat(name)
+	if err != nil {
+		return nil, nil, err
+	}
+	if info.IsDir() {
+		store, err := History.OpenReadOnly(name)
+		if err != nil {
+			return nil, nil, err
+		}
+		return store, func() { store.Close() }, nil
+	}
+	tmpDir, err := ioutil.TempDir("", "painttyAdmin")
+	if err != nil {
+		return nil, nil, err
+	}
+	var dir = filepath.Join(tmpDir, "history")
+	if err := History.ImportLegacy(name, dir, History.DEFAULT_SEGMENT_SIZE); err != nil {
+		os.RemoveAll(tmpDir)
+		return nil, nil, err
+	}
+	store, err = History.OpenReadOnly(dir)
+	if err != nil {
+		os.RemoveAll(tmpDir)
+		return nil, nil, err
+	}
+	return store, func() {
+		store.Close()
+		os.RemoveAll(tmpDir)
+	}, nil
+}
+
+// sameTimestamps tells if timestamps don't help, like in migrated history.
+func sameTimestamps(store *History.Store) bool {
+	var entries = store.Entries()
+	return len(entries) > 1 && entries[0].Timestamp == entries[len(entries)-1].Timestamp
+}
+
+func writePNGFrame(name string, img image.Image) error {
+	file, err := os.Create(name)
+	if err != nil {
+		return err
+	}
+	err = png.Encode(file, img)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// errTooManyFrames tells that a gif would be too large to keep in memory.
+var errTooManyFrames = errors.New("too many frames for gif, use -max_frames, or png")
+
+func timelapse(name, outDir, format string, width, height int, scale float64,
+	options Canvas.TimelapseOptions, delay, maxFrames int) error {
+	store, cleanup, err := openHistory(name)
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+	if width <= 0 || height <= 0 {
+		var ok bool
+		if width, height, ok = Canvas.SizeOf(store); !ok {
+			return errUnknownSize
+		}
+	}
+	if options.Packs == 0 && sameTimestamps(store) {
+		fmt.Printf("%s: packs share one timestamp, use -packs for more frames\n", name)
+	}
+
+	var base = strings.TrimSuffix(filepath.Base(name), ".data")
+	var animation = &gif.GIF{}
+	var count int
+	err = Canvas.NewCanvas(width, height).Timelapse(store, options, func(frame *image.RGBA, at time.Time) error {
+		var img = Canvas.Scale(frame, scale)
+		count++
+		if format == "gif" {
+			// every frame is kept until the whole gif is encoded
+			if maxFrames > 0 && count > maxFrames {
+				return errTooManyFrames
+			}
+			var paletted = image.NewPaletted(img.Bounds(), palette.Plan9)
+			draw.FloydSteinberg.Draw(paletted, img.Bounds(), img, image.ZP)
+			animation.Image = append(animation.Image, paletted)
+			animation.Delay = append(animation.Delay, delay)
+			return nil
+		}
+		return writePNGFrame(filepath.Join(outDir, fmt.Sprintf("%s-%05d.png", base, count)), img)
+	})
+	if err != nil {
+		return err
+	}
+	if format == "gif" {
+		var out = filepath.Join(outDir, base+".gif")
+		file, err := os.Create(out)
+		if err != nil {
+			return err
+		}
+		err = gif.EncodeAll(file, animation)
+		if closeErr := file.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			return err
+		}
+		fmt.Printf("%s: %d frames to %s\n", name, count, out)
+		return nil
+	}
+	fmt.Printf("%s: %d frames to %s\n", name, count, filepath.Join(outDir, base+"-*.png"))
+	return nil
+}
+
+func runTimelapse(args []string) error {
+	var flags = flag.NewFlagSet("timelapse", flag.ExitOnError)
+	var dataDir = flags.String("data_dir", "./data/data", "data_dir of server")
+	var outDir = flags.String("out", "", "where to put frames, data_dir/timelapse by default")
+	var format = flags.String("format", "png", "png for numbered frames, or gif")
+	var interval = flags.Duration("interval", 10*time.Second, "recording time between frames, 0 disables")
+	var packs = flags.Int("packs", 0, "packs between frames, 0 disables")
+	var scale = flags.Float64("scale", 1, "scale of frames to canvas")
+	var delay = flags.Int("delay", 10, "delay of each gif frame, in 1/100 seconds")
+	var maxFrames = flags.Int("max_frames", 300, "gif with more frames is refused, 0 never refuses")
+	var dbDir = flags.String("db_dir", "./data/db", "db_dir of server, where canvas size of rooms is")
+	var width = flags.Int("width", 0, "canvas width, from db_dir or history by default")
+	var height = flags.Int("height", 0, "canvas height, from db_dir or history by default")
+	flags.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: painttyAdmin timelapse [-data_dir dir] [-db_dir dir] [-out dir] [-format png|gif] [-max_frames 300] [-interval 10s] [-packs n] [-scale 1] [-width w -height h] history...")
+		fmt.Fprintln(os.Stderr, "history is a signature, or a path")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if *format != "png" && *format != "gif" {
+		return Canvas.ErrUnknownFormat
+	}
+	if *scale <= 0 || (*interval <= 0 && *packs <= 0) || flags.NArg() == 0 {
+		flags.Usage()
+		os.Exit(2)
+	}
+	if *outDir == "" {
+		*outDir = filepath.Join(*dataDir, "timelapse")
+	}
+	if err := os.MkdirAll(*outDir, 0755); err != nil {
+		return err
+	}
+
+	var options = Canvas.TimelapseOptions{
+		Interval: *interval,
+		Packs:    *packs,
+	}
+	var sizes = roomSizes(*dbDir)
+	var failed error
+	for _, name := range flags.Args() {
+		if _, err := os.Stat(name); os.IsNotExist(err) {
+			name = filepath.Join(*dataDir, name)
+		}
+		width, height := sizeOf(sizes, name, *width, *height)
+		if err := timelapse(name, *outDir, *format, width, height, *scale, options, *delay, *maxFrames); err != nil {
+			fmt.Printf("%s: %v\n", name, err)
+			failed = errFailed
+		}
+	}
+	return failed
+}
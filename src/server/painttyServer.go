@@ -6,6 +6,7 @@ import (
 	"server/pkg/Config"
 	"server/pkg/Logger"
 	"server/pkg/RoomManager"
+	"server/pkg/Socket"
 	"time"
 )
 
@@ -19,9 +20,19 @@ func init() {
 	}()
 }
 
+func applySocketLimits() {
+	Socket.SetLimits(Socket.SocketLimits{
+		MaxPackSize:         Config.ReadConfInt("max_pack_size", Socket.DEFAULT_MAX_PACK_SIZE),
+		MaxUncompressedSize: Config.ReadConfInt("max_uncompressed_size", Socket.DEFAULT_MAX_UNCOMPRESSED_SIZE),
+		ReadTimeout:         time.Duration(Config.ReadConfInt("read_timeout", int(Socket.DEFAULT_READ_TIMEOUT/time.Second))) * time.Second,
+		WriteTimeout:        time.Duration(Config.ReadConfInt("write_timeout", int(Socket.DEFAULT_WRITE_TIMEOUT/time.Second))) * time.Second,
+	})
+}
+
 func main() {
 	logger.SetupLogs("painttyServer")
 	Config.InitConf()
+	applySocketLimits()
 	var manager = RoomManager.ServeManager()
 
 	ticker := time.NewTicker(10 * time.Minute)
@@ -31,6 +42,7 @@ func main() {
 			select {
 			case <-ticker.C:
 				Config.ReloadConf()
+				applySocketLimits()
 			case <-quit:
 				ticker.Stop()
 				return
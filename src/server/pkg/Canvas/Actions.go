@@ -0,0 +1,95 @@
+package Canvas
+
+import (
+	"encoding/json"
+	"errors"
+	"image"
+	"server/pkg/Socket"
+	"strings"
+)
+
+var ErrUnknownAction = errors.New("unknown paint action")
+
+type Color struct {
+	Red   int `json:"red"`
+	Green int `json:"green"`
+	Blue  int `json:"blue"`
+}
+
+type Brush struct {
+	Width float64 `json:"width"`
+	Color Color   `json:"color"`
+	Name  string  `json:"name"`
+}
+
+// IsEraser tells if brush clears pixels rather than paints.
+func (b Brush) IsEraser() bool {
+	return strings.EqualFold(b.Name, "eraser")
+}
+
+type Point struct {
+	X        float64  `json:"x"`
+	Y        float64  `json:"y"`
+	Pressure *float64 `json:"pressure,omitempty"`
+}
+
+// PaintAction is any of drawpoint, drawline, block and layerimage, see
+// docs/formats.md.
+type PaintAction struct {
+	Action   string   `json:"action"`
+	Layer    string   `json:"layer"`
+	UserId   string   `json:"userid"`
+	Name     string   `json:"name"`
+	Brush    Brush    `json:"brush"`
+	Pressure *float64 `json:"pressure,omitempty"`
+	Point    *Point   `json:"point,omitempty"`
+	Start    *Point   `json:"start,omitempty"`
+	End      *Point   `json:"end,omitempty"`
+	Block    []Point  `json:"block,omitempty"`
+	Image    string   `json:"image,omitempty"`
+	X        *int     `json:"x,omitempty"` // of layerimage tile
+	Y        *int     `json:"y,omitempty"`
+}
+
+func DecodeAction(data []byte) (*PaintAction, error) {
+	var action = &PaintAction{}
+	if err := json.Unmarshal(data, action); err != nil {
+		return nil, err
+	}
+	return action, nil
+}
+
+// DecodeFrame decodes a DATA pack as recorded in history.
+func DecodeFrame(frame []byte) (*PaintAction, error) {
+	pkg, err := Socket.DecodeFrame(frame)
+	if err != nil {
+		return nil, err
+	}
+	if pkg.PackageType != Socket.DATA {
+		return nil, ErrUnknownAction
+	}
+	return DecodeAction(pkg.Unpacked)
+}
+
+func pointOf(x, y *int) image.Point {
+	var at image.Point
+	if x != nil {
+		at.X = *x
+	}
+	if y != nil {
+		at.Y = *y
+	}
+	return at
+}
+
+// pressureOf falls back to fallback, and then full pressure, for clients
+// without pressure info.
+func pressureOf(pressure, fallback *float64) float64 {
+	if pressure != nil {
+		return *pressure
+	}
+	if fallback != nil {
+		return *fallback
+	}
+	return 1
+}
@@ -0,0 +1,289 @@
+// Canvas renders recorded paint actions, so server knows what a room
+// looks like. Each layer is an RGBA image, and layers are stacked by name.
+package Canvas
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+type Canvas struct {
+	Width  int
+	Height int
+	layers map[string]*image.RGBA
+	budget int // pixels the pack being applied may still touch
+}
+
+func NewCanvas(width, height int) *Canvas {
+	return &Canvas{
+		Width:  width,
+		Height: height,
+		layers: make(map[string]*image.RGBA),
+	}
+}
+
+// Layer returns image of layer name, and creates an empty one if needed.
+func (c *Canvas) Layer(name string) *image.RGBA {
+	layer, ok := c.layers[name]
+	if !ok {
+		layer = image.NewRGBA(image.Rect(0, 0, c.Width, c.Height))
+		c.layers[name] = layer
+	}
+	return layer
+}
+
+// SetLayer replaces image of layer name.
+func (c *Canvas) SetLayer(name string, img image.Image) {
+	var layer = image.NewRGBA(image.Rect(0, 0, c.Width, c.Height))
+	draw.Draw(layer, layer.Bounds(), img, img.Bounds().Min, draw.Src)
+	c.layers[name] = layer
+}
+
+// SetTile replaces pixels of layer name under img, whose top-left is at.
+func (c *Canvas) SetTile(name string, img image.Image, at image.Point) {
+	var layer = c.Layer(name)
+	var bounds = img.Bounds()
+	draw.Draw(layer, bounds.Sub(bounds.Min).Add(at), img, bounds.Min, draw.Src)
+}
+
+func (c *Canvas) RemoveLayer(name string) {
+	delete(c.layers, name)
+}
+
+// layerLess puts layer0 under layer1, and layer2 under layer10.
+func layerLess(a, b string) bool {
+	var prefixA = strings.TrimRight(a, "0123456789")
+	var prefixB = strings.TrimRight(b, "0123456789")
+	if prefixA == prefixB {
+		numA, errA := strconv.Atoi(a[len(prefixA):])
+		numB, errB := strconv.Atoi(b[len(prefixB):])
+		if errA == nil && errB == nil && numA != numB {
+			return numA < numB
+		}
+	}
+	return a < b
+}
+
+// Layers are names of layers from bottom to top.
+func (c *Canvas) Layers() []string {
+	var names = make([]string, 0, len(c.layers))
+	for name := range c.layers {
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool {
+		return layerLess(names[i], names[j])
+	})
+	return names
+}
+
+// Flatten stacks all layers onto a white background.
+func (c *Canvas) Flatten() *image.RGBA {
+	var result = image.NewRGBA(image.Rect(0, 0, c.Width, c.Height))
+	draw.Draw(result, result.Bounds(), image.NewUniform(color.White), image.ZP, draw.Src)
+	for _, name := range c.Layers() {
+		draw.Draw(result, result.Bounds(), c.layers[name], image.ZP, draw.Over)
+	}
+	return result
+}
+
+// Apply renders one paint action. Rendering stops once the action touches
+// more than MAX_PACK_PIXELS pixels, and ErrTooExpensive is returned.
+func (c *Canvas) Apply(action *PaintAction) error {
+	c.budget = MAX_PACK_PIXELS
+	switch action.Action {
+	case "drawpoint":
+		if action.Point == nil {
+			return ErrUnknownAction
+		}
+		c.dab(c.Layer(action.Layer), action.Brush, *action.Point, pressureOf(action.Pressure, action.Point.Pressure))
+	case "drawline":
+		if action.Start == nil || action.End == nil {
+			return ErrUnknownAction
+		}
+		var pressure = pressureOf(action.Pressure, nil)
+		c.line(c.Layer(action.Layer), action.Brush, *action.Start, *action.End, pressure, pressure)
+	case "block":
+		var layer = c.Layer(action.Layer)
+		for i, point := range action.Block {
+			if c.budget < 0 {
+				break
+			}
+			var pressure = pressureOf(point.Pressure, action.Pressure)
+			if i == 0 {
+				c.dab(layer, action.Brush, point, pressure)
+				continue
+			}
+			var last = action.Block[i-1]
+			c.line(layer, action.Brush, last, point, pressureOf(last.Pressure, action.Pressure), pressure)
+		}
+	case "layerimage":
+		img, err := decodeImage(action.Image)
+		if err != nil {
+			return err
+		}
+		if action.X != nil || action.Y != nil {
+			c.SetTile(action.Layer, img, pointOf(action.X, action.Y))
+		} else {
+			c.SetLayer(action.Layer, img)
+		}
+	default:
+		return ErrUnknownAction
+	}
+	if c.budget < 0 {
+		return ErrTooExpensive
+	}
+	return nil
+}
+
+// ApplyPack renders json of a DATA pack.
+func (c *Canvas) ApplyPack(data []byte) error {
+	action, err := DecodeAction(data)
+	if err != nil {
+		return err
+	}
+	return c.Apply(action)
+}
+
+// ApplyFrame renders a DATA pack as recorded in history.
+func (c *Canvas) ApplyFrame(frame []byte) error {
+	action, err := DecodeFrame(frame)
+	if err != nil {
+		return err
+	}
+	return c.Apply(action)
+}
+
+// line stamps dabs from start to end, a fraction of brush radius apart.
+// Only the part which may touch canvas is drawn.
+func (c *Canvas) line(layer *image.RGBA, brush Brush, start, end Point, startPressure, endPressure float64) {
+	var radius = math.Max(radiusOf(brush, startPressure), radiusOf(brush, endPressure))
+	var margin = radius + 1
+	t0, t1, ok := clipSegment(start, end, -margin, -margin, float64(c.Width)+margin, float64(c.Height)+margin)
+	if !ok {
+		return
+	}
+	var distance = math.Hypot(end.X-start.X, end.Y-start.Y) * (t1 - t0)
+	var spacing = math.Max(radius*DAB_SPACING, 1)
+	var steps = int(math.Ceil(distance / spacing))
+	if steps < 1 {
+		steps = 1
+	}
+	for i := 1; i <= steps && c.budget >= 0; i++ {
+		var t = t0 + (t1-t0)*float64(i)/float64(steps)
+		c.dab(layer, brush, Point{
+			X: start.X + (end.X-start.X)*t,
+			Y: start.Y + (end.Y-start.Y)*t,
+		}, startPressure+(endPressure-startPressure)*t)
+	}
+}
+
+// clipSegment finds the part of segment from start to end inside the
+// rectangle, as fractions of the segment. It's the Liang-Barsky algorithm.
+func clipSegment(start, end Point, minX, minY, maxX, maxY float64) (float64, float64, bool) {
+	var t0, t1 = 0.0, 1.0
+	var dx, dy = end.X - start.X, end.Y - start.Y
+	var edges = [4][2]float64{
+		{-dx, start.X - minX},
+		{dx, maxX - start.X},
+		{-dy, start.Y - minY},
+		{dy, maxY - start.Y},
+	}
+	for _, edge := range edges {
+		var p, q = edge[0], edge[1]
+		if p == 0 {
+			if q < 0 {
+				return 0, 0, false // parallel, and outside
+			}
+			continue
+		}
+		var t = q / p
+		if p < 0 {
+			t0 = math.Max(t0, t)
+		} else {
+			t1 = math.Min(t1, t)
+		}
+		if t0 > t1 {
+			return 0, 0, false
+		}
+	}
+	return t0, t1, true
+}
+
+func radiusOf(brush Brush, pressure float64) float64 {
+	if pressure < 0 {
+		pressure = 0
+	}
+	if pressure > 1 {
+		pressure = 1
+	}
+	var radius = brush.Width * pressure / 2
+	if radius < 0.5 {
+		radius = 0.5
+	}
+	return radius
+}
+
+// dab stamps a round brush tip, whose diameter is brush width scaled by
+// pressure. Edge pixels are partly covered.
+func (c *Canvas) dab(layer *image.RGBA, brush Brush, center Point, pressure float64) {
+	var radius = radiusOf(brush, pressure)
+	var minX = int(math.Floor(center.X - radius - 1))
+	var maxX = int(math.Ceil(center.X + radius + 1))
+	var minY = int(math.Floor(center.Y - radius - 1))
+	var maxY = int(math.Ceil(center.Y + radius + 1))
+	var bounds = image.Rect(minX, minY, maxX, maxY).Intersect(layer.Bounds())
+	var area = bounds.Dx() * bounds.Dy()
+	if area > c.budget {
+		c.budget = -1
+		return
+	}
+	c.budget -= area
+
+	var src = [3]uint32{
+		uint32(clampChannel(brush.Color.Red)),
+		uint32(clampChannel(brush.Color.Green)),
+		uint32(clampChannel(brush.Color.Blue)),
+	}
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			// distance from pixel center
+			var d = math.Hypot(float64(x)+0.5-center.X, float64(y)+0.5-center.Y)
+			var coverage = radius + 0.5 - d
+			if coverage <= 0 {
+				continue
+			}
+			if coverage > 1 {
+				coverage = 1
+			}
+			var a = uint32(coverage * 255)
+			var i = layer.PixOffset(x, y)
+			var pix = layer.Pix[i : i+4 : i+4]
+			if brush.IsEraser() {
+				for k := 0; k < 4; k++ {
+					pix[k] = uint8(uint32(pix[k]) * (255 - a) / 255)
+				}
+				continue
+			}
+			// premultiplied over
+			for k := 0; k < 3; k++ {
+				pix[k] = uint8((src[k]*a + uint32(pix[k])*(255-a)) / 255)
+			}
+			pix[3] = uint8((255*a + uint32(pix[3])*(255-a)) / 255)
+		}
+	}
+}
+
+func clampChannel(value int) uint8 {
+	if value < 0 {
+		return 0
+	}
+	if value > 255 {
+		return 255
+	}
+	return uint8(value)
+}
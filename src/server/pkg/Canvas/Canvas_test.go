@@ -0,0 +1,418 @@
+package Canvas
+
+import "testing"
+
+import "image/color"
+import "server/pkg/Socket"
+import "server/pkg/History"
+import "io/ioutil"
+import "os"
+import "strconv"
+import "archive/zip"
+import "bytes"
+import "encoding/xml"
+import "image/png"
+import "image"
+import "time"
+
+func rgba(canvas *Canvas, layer string, x, y int) color.RGBA {
+	return canvas.Layer(layer).RGBAAt(x, y)
+}
+
+func TestDrawPoint(t *testing.T) {
+	var canvas = NewCanvas(100, 100)
+	err := canvas.ApplyPack([]byte(`{"action":"drawpoint","point":{"x":50,"y":50},
+		"brush":{"width":10,"color":{"red":255,"green":0,"blue":0},"name":"Brush"},
+		"pressure":1,"layer":"layer0"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c := rgba(canvas, "layer0", 50, 50); c != (color.RGBA{255, 0, 0, 255}) {
+		t.Error("center of point should be painted", c)
+	}
+	if c := rgba(canvas, "layer0", 57, 50); c.A != 0 {
+		t.Error("outside of brush should not be painted", c)
+	}
+}
+
+func TestPressure(t *testing.T) {
+	var canvas = NewCanvas(100, 100)
+	canvas.ApplyPack([]byte(`{"action":"drawpoint","point":{"x":50,"y":50},
+		"brush":{"width":20,"color":{"red":0,"green":0,"blue":0}},"pressure":0.2,"layer":"layer0"}`))
+	if c := rgba(canvas, "layer0", 50, 50); c.A != 255 {
+		t.Error("center of point should be painted", c)
+	}
+	if c := rgba(canvas, "layer0", 55, 50); c.A != 0 {
+		t.Error("light pressure should make a smaller point", c)
+	}
+}
+
+func TestDrawLine(t *testing.T) {
+	var canvas = NewCanvas(100, 100)
+	canvas.ApplyPack([]byte(`{"action":"drawline","start":{"x":10,"y":10},"end":{"x":90,"y":10},
+		"brush":{"width":4,"color":{"red":0,"green":0,"blue":255}},"pressure":1,"layer":"layer1"}`))
+	for _, x := range []int{10, 50, 89} {
+		if c := rgba(canvas, "layer1", x, 10); c != (color.RGBA{0, 0, 255, 255}) {
+			t.Error("line should be painted at", x, c)
+		}
+	}
+	if c := rgba(canvas, "layer1", 50, 20); c.A != 0 {
+		t.Error("line should be thin", c)
+	}
+}
+
+func TestBlockAndEraser(t *testing.T) {
+	var canvas = NewCanvas(100, 100)
+	canvas.ApplyPack([]byte(`{"action":"block","layer":"layer0","block":[
+		{"x":10,"y":50,"pressure":1},{"x":50,"y":50,"pressure":1},{"x":50,"y":90,"pressure":1}],
+		"brush":{"width":6,"color":{"red":0,"green":255,"blue":0}}}`))
+	for _, p := range [][2]int{{10, 50}, {30, 50}, {50, 70}} {
+		if c := rgba(canvas, "layer0", p[0], p[1]); c != (color.RGBA{0, 255, 0, 255}) {
+			t.Error("block should be painted at", p, c)
+		}
+	}
+
+	canvas.ApplyPack([]byte(`{"action":"drawpoint","point":{"x":30,"y":50},
+		"brush":{"width":10,"color":{"red":0,"green":0,"blue":0},"name":"Eraser"},"pressure":1,"layer":"layer0"}`))
+	if c := rgba(canvas, "layer0", 30, 50); c.A != 0 {
+		t.Error("eraser should clear pixels", c)
+	}
+	if c := rgba(canvas, "layer0", 50, 70); c.A != 255 {
+		t.Error("eraser should not clear others", c)
+	}
+}
+
+func TestOutOfCanvas(t *testing.T) {
+	var canvas = NewCanvas(10, 10)
+	err := canvas.ApplyPack([]byte(`{"action":"drawline","start":{"x":-100,"y":-100},"end":{"x":200,"y":200},
+		"brush":{"width":1000,"color":{"red":300,"green":-1,"blue":0}},"pressure":5,"layer":"layer0"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c := rgba(canvas, "layer0", 5, 5); c != (color.RGBA{255, 0, 0, 255}) {
+		t.Error("values out of range should be clamped", c)
+	}
+}
+
+func TestDrawingCost(t *testing.T) {
+	var canvas = NewCanvas(100, 100)
+	// far away from canvas, only the part crossing it is stepped through
+	var start = time.Now()
+	err := canvas.ApplyPack([]byte(`{"action":"drawline","start":{"x":-1e9,"y":50},"end":{"x":1e9,"y":50},
+		"brush":{"width":4,"color":{"red":0,"green":0,"blue":0}},"pressure":1,"layer":"layer0"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if time.Since(start) > time.Second {
+		t.Error("line outside canvas should be clipped", time.Since(start))
+	}
+	if c := rgba(canvas, "layer0", 50, 50); c.A != 255 {
+		t.Error("line should be painted inside canvas", c)
+	}
+	if err := canvas.ApplyPack([]byte(`{"action":"drawline","start":{"x":-500,"y":-500},"end":{"x":-600,"y":-600},
+		"brush":{"width":4,"color":{"red":0,"green":0,"blue":0}},"pressure":1,"layer":"layer1"}`)); err != nil {
+		t.Error("line outside canvas should be fine", err)
+	}
+
+	var big = NewCanvas(4000, 4000)
+	var block bytes.Buffer
+	for i := 0; i < 100; i++ {
+		block.WriteString(`{"x":500,"y":500},{"x":3500,"y":3500},`)
+	}
+	err = big.ApplyPack([]byte(`{"action":"block","block":[` + block.String() + `{"x":0,"y":0}],
+		"brush":{"width":500,"color":{"red":0,"green":0,"blue":0}},"pressure":1,"layer":"layer0"}`))
+	if err != ErrTooExpensive {
+		t.Error("work of a pack should be capped", err)
+	}
+	if c := big.Layer("layer0").RGBAAt(2000, 2000); c.A != 255 {
+		t.Error("pack should be drawn until the cap", c)
+	}
+}
+
+func TestUnknownAction(t *testing.T) {
+	var canvas = NewCanvas(10, 10)
+	if err := canvas.ApplyPack([]byte(`{"action":"spray"}`)); err != ErrUnknownAction {
+		t.Error("unknown action should be reported", err)
+	}
+	if err := canvas.ApplyPack([]byte(`not json`)); err == nil {
+		t.Error("broken json should be reported")
+	}
+}
+
+func TestValidate(t *testing.T) {
+	var cases = []struct {
+		data string
+		err  error
+	}{
+		{`{"action":"drawline","start":{"x":-5,"y":0},"end":{"x":150,"y":100},
+			"brush":{"width":10,"color":{"red":255,"green":0,"blue":0}},"pressure":0.5,"layer":"layer0"}`, nil},
+		{`{"action":"block","layer":"layer0","block":[{"x":1,"y":1},{"x":2,"y":2,"pressure":0.3}],
+			"brush":{"width":1,"color":{"red":0,"green":0,"blue":0}}}`, nil},
+		{`{"action":"layerimage","layer":"layer0","image":""}`, ErrUnknownAction},
+		{`{"action":"drawline","start":{"x":1,"y":1},"brush":{"width":1},"layer":"layer0"}`, ErrMissingPoint},
+		{`{"action":"block","block":[],"brush":{"width":1},"layer":"layer0"}`, ErrMissingPoint},
+		{`{"action":"drawpoint","point":{"x":1,"y":1},"brush":{"width":1}}`, ErrInvalidLayer},
+		{`{"action":"drawpoint","point":{"x":1,"y":1000},"brush":{"width":1},"layer":"layer0"}`, ErrOutOfCanvas},
+		{`{"action":"drawpoint","point":{"x":1,"y":1},"brush":{"width":0},"layer":"layer0"}`, ErrInvalidBrush},
+		{`{"action":"drawpoint","point":{"x":1,"y":1},"brush":{"width":1,"color":{"red":256}},"layer":"layer0"}`, ErrInvalidBrush},
+		{`{"action":"drawpoint","point":{"x":1,"y":1},"brush":{"width":1},"pressure":5,"layer":"layer0"}`, ErrInvalidPressure},
+		{`{"action":"block","layer":"layer0","block":[{"x":1,"y":1,"pressure":-1}],"brush":{"width":1}}`, ErrInvalidPressure},
+	}
+	for _, c := range cases {
+		action, err := DecodeAction([]byte(c.data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := action.Validate(100, 100); err != c.err {
+			t.Error("unexpected validation", c.data, err)
+		}
+	}
+}
+
+func TestFlatten(t *testing.T) {
+	var canvas = NewCanvas(10, 10)
+	canvas.ApplyPack([]byte(`{"action":"drawpoint","point":{"x":5,"y":5},
+		"brush":{"width":4,"color":{"red":0,"green":0,"blue":255}},"pressure":1,"layer":"layer10"}`))
+	canvas.ApplyPack([]byte(`{"action":"drawpoint","point":{"x":5,"y":5},
+		"brush":{"width":4,"color":{"red":255,"green":0,"blue":0}},"pressure":1,"layer":"layer2"}`))
+	if layers := canvas.Layers(); len(layers) != 2 || layers[0] != "layer2" {
+		t.Error("unexpected layer order", layers)
+	}
+	var flat = canvas.Flatten()
+	if c := flat.RGBAAt(5, 5); c != (color.RGBA{0, 0, 255, 255}) {
+		t.Error("upper layer should cover lower one", c)
+	}
+	if c := flat.RGBAAt(0, 0); c != (color.RGBA{255, 255, 255, 255}) {
+		t.Error("background should be white", c)
+	}
+}
+
+func TestApplyFrame(t *testing.T) {
+	var canvas = NewCanvas(10, 10)
+	var data = []byte(`{"action":"drawpoint","point":{"x":5,"y":5},
+		"brush":{"width":4,"color":{"red":1,"green":2,"blue":3}},"pressure":1,"layer":"layer0"}`)
+	var frame = Socket.AssamblePack(Socket.PackHeader{Compress: true, PackType: Socket.DATA}, data)
+	if err := canvas.ApplyFrame(frame); err != nil {
+		t.Fatal(err)
+	}
+	if c := rgba(canvas, "layer0", 5, 5); c != (color.RGBA{1, 2, 3, 255}) {
+		t.Error("frame should be rendered", c)
+	}
+}
+
+func TestSnapshotAndRender(t *testing.T) {
+	dir, err := ioutil.TempDir("", "canvas")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	store, err := History.Open(dir, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	var point = func(x int, layer string) []byte {
+		return Socket.AssamblePack(Socket.PackHeader{Compress: true, PackType: Socket.DATA},
+			[]byte(`{"action":"drawpoint","point":{"x":`+strconv.Itoa(x)+`,"y":5},
+			"brush":{"width":4,"color":{"red":9,"green":9,"blue":9}},"pressure":1,"layer":"`+layer+`"}`))
+	}
+	store.Write(point(2, "layer0"))
+	store.Write(point(5, "layer1"))
+
+	canvas, offset, err := Render(store, 10, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	snapshot, err := canvas.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, ok := SizeOf(store); ok {
+		t.Error("size should be unknown without layer images")
+	}
+	store.SaveSnapshot(offset, snapshot)
+	store.Write(point(8, "layer0"))
+	if width, height, ok := SizeOf(store); !ok || width != 10 || height != 10 {
+		t.Error("size should be found in snapshot", width, height, ok)
+	}
+
+	// from snapshot
+	canvas, offset, err = Render(store, 10, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if offset != store.End() {
+		t.Error("canvas should be rendered to end", offset, store.End())
+	}
+	for _, p := range []struct {
+		x     int
+		layer string
+	}{{2, "layer0"}, {5, "layer1"}, {8, "layer0"}} {
+		if c := rgba(canvas, p.layer, p.x, 5); c != (color.RGBA{9, 9, 9, 255}) {
+			t.Error("point should be painted", p, c)
+		}
+	}
+}
+
+func TestSnapshotTiles(t *testing.T) {
+	var canvas = NewCanvas(64, 48)
+	for i := 0; i < 20; i++ {
+		canvas.ApplyPack([]byte(`{"action":"drawline","start":{"x":` + strconv.Itoa(i*3) + `,"y":0},
+			"end":{"x":64,"y":` + strconv.Itoa(i*2) + `},"brush":{"width":3,"color":{"red":` + strconv.Itoa(i*10) +
+			`,"green":9,"blue":9}},"pressure":1,"layer":"layer0"}`))
+	}
+	var limits = Socket.Limits()
+	defer Socket.SetLimits(limits)
+	var small = limits
+	small.MaxPackSize = 1024
+
+	whole, err := canvas.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	Socket.SetLimits(small)
+	snapshot, err := canvas.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var tiles int
+	History.ReadFrames(bytes.NewReader(snapshot), func(frame []byte) error {
+		pkg, _ := Socket.DecodeFrame(frame)
+		if len(pkg.Unpacked) > small.MaxPackSize {
+			t.Error("tile is larger than limit", len(pkg.Unpacked))
+		}
+		tiles++
+		return nil
+	})
+	if tiles < 2 {
+		t.Error("layer should be split into tiles", tiles)
+	}
+
+	// PNG is not premultiplied, so compare with a layer restored as whole
+	var restored, expected = NewCanvas(64, 48), NewCanvas(64, 48)
+	if err := restored.Restore(snapshot); err != nil {
+		t.Fatal(err)
+	}
+	expected.Restore(whole)
+	if !bytes.Equal(restored.Layer("layer0").Pix, expected.Layer("layer0").Pix) {
+		t.Error("tiles should restore the layer")
+	}
+}
+
+func TestExport(t *testing.T) {
+	var canvas = NewCanvas(600, 300)
+	canvas.ApplyPack([]byte(`{"action":"drawpoint","point":{"x":5,"y":5},
+		"brush":{"width":4,"color":{"red":0,"green":0,"blue":255}},"pressure":1,"layer":"layer0"}`))
+	canvas.ApplyPack([]byte(`{"action":"drawpoint","point":{"x":5,"y":5},
+		"brush":{"width":4,"color":{"red":255,"green":0,"blue":0}},"pressure":1,"layer":"layer1"}`))
+
+	var buf bytes.Buffer
+	if err := canvas.Export(FORMAT_PNG, &buf); err != nil {
+		t.Fatal(err)
+	}
+	img, err := png.Decode(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r, g, b, _ := img.At(5, 5).RGBA(); r>>8 != 255 || g != 0 || b != 0 {
+		t.Error("png should be flattened", r, g, b)
+	}
+
+	buf.Reset()
+	if err := canvas.Export(FORMAT_ORA, &buf); err != nil {
+		t.Fatal(err)
+	}
+	archive, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first := archive.File[0]; first.Name != "mimetype" || first.Method != zip.Store {
+		t.Error("mimetype should come first uncompressed", first.Name, first.Method)
+	}
+	var files = make(map[string]*zip.File)
+	for _, file := range archive.File {
+		files[file.Name] = file
+	}
+	reader, err := files["stack.xml"].Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var stack oraImage
+	if err := xml.NewDecoder(reader).Decode(&stack); err != nil {
+		t.Fatal(err)
+	}
+	if len(stack.Layers) != 2 || stack.Layers[0].Name != "layer1" || stack.Width != 600 {
+		t.Error("unexpected stack", stack)
+	}
+	reader, err = files["Thumbnail/thumbnail.png"].Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	thumb, err := png.Decode(reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if thumb.Bounds().Dx() != 256 || thumb.Bounds().Dy() != 128 {
+		t.Error("unexpected thumbnail size", thumb.Bounds())
+	}
+	if _, ok := files[stack.Layers[1].Src]; !ok {
+		t.Error("layer image is missing", stack.Layers[1].Src)
+	}
+
+	if err := canvas.Export("psd", &buf); err != ErrUnknownFormat {
+		t.Error("unknown format should be reported", err)
+	}
+}
+
+func TestTimelapse(t *testing.T) {
+	dir, err := ioutil.TempDir("", "canvas")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	store, err := History.Open(dir, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	var start = time.Unix(1000, 0)
+	// painted in 3 bursts, with a long break before the last one
+	for i, at := range []time.Duration{0, 1, 2, 10, 11, 3600} {
+		store.WriteAt(Socket.AssamblePack(Socket.PackHeader{Compress: true, PackType: Socket.DATA},
+			[]byte(`{"action":"drawpoint","point":{"x":`+strconv.Itoa(i*3+1)+`,"y":5},
+			"brush":{"width":2,"color":{"red":0,"green":0,"blue":0}},"pressure":1,"layer":"layer0"}`)),
+			start.Add(at*time.Second))
+	}
+
+	var frames []time.Time
+	var painted []int
+	var record = func(frame *image.RGBA, at time.Time) error {
+		frames = append(frames, at)
+		var count int
+		for x := 0; x < 20; x++ {
+			if frame.RGBAAt(x, 5).R < 128 {
+				count++
+			}
+		}
+		painted = append(painted, count)
+		return nil
+	}
+	if err := NewCanvas(20, 10).Timelapse(store, TimelapseOptions{Interval: 5 * time.Second}, record); err != nil {
+		t.Fatal(err)
+	}
+	if len(frames) != 3 || !frames[0].Equal(start.Add(2*time.Second)) || !frames[2].Equal(start.Add(time.Hour)) {
+		t.Error("unexpected frames", frames)
+	}
+	if painted[0] >= painted[1] || painted[1] >= painted[2] {
+		t.Error("each frame should show more", painted)
+	}
+
+	frames = nil
+	painted = nil
+	NewCanvas(20, 10).Timelapse(store, TimelapseOptions{Packs: 2}, record)
+	if len(frames) != 3 {
+		t.Error("unexpected frames by packs", frames)
+	}
+}
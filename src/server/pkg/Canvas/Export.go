@@ -0,0 +1,205 @@
+package Canvas
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"image"
+	"image/png"
+	"io"
+	"server/pkg/History"
+	"server/pkg/Socket"
+)
+
+const (
+	FORMAT_PNG = "png" // flattened
+	FORMAT_ORA = "ora" // layered OpenRaster
+
+	ORA_MIMETYPE       = "image/openraster"
+	ORA_THUMBNAIL_SIZE = 256
+)
+
+var ErrUnknownFormat = errors.New("unknown export format")
+
+// Export writes canvas to w in format.
+func (c *Canvas) Export(format string, w io.Writer) error {
+	switch format {
+	case FORMAT_PNG:
+		return png.Encode(w, c.Flatten())
+	case FORMAT_ORA:
+		return c.exportORA(w)
+	}
+	return ErrUnknownFormat
+}
+
+type oraLayer struct {
+	Name       string `xml:"name,attr"`
+	Src        string `xml:"src,attr"`
+	X          int    `xml:"x,attr"`
+	Y          int    `xml:"y,attr"`
+	Opacity    string `xml:"opacity,attr"`
+	Visibility string `xml:"visibility,attr"`
+}
+
+type oraImage struct {
+	XMLName xml.Name   `xml:"image"`
+	Version string     `xml:"version,attr"`
+	Width   int        `xml:"w,attr"`
+	Height  int        `xml:"h,attr"`
+	Layers  []oraLayer `xml:"stack>layer"`
+}
+
+// exportORA writes an OpenRaster zip, where mimetype comes first and is not
+// compressed, and stack.xml lists layers from top to bottom.
+func (c *Canvas) exportORA(w io.Writer) error {
+	var archive = zip.NewWriter(w)
+	mimetype, err := archive.CreateHeader(&zip.FileHeader{
+		Name:   "mimetype",
+		Method: zip.Store,
+	})
+	if err != nil {
+		return err
+	}
+	io.WriteString(mimetype, ORA_MIMETYPE)
+
+	var stack = oraImage{
+		Version: "0.0.3",
+		Width:   c.Width,
+		Height:  c.Height,
+	}
+	var names = c.Layers()
+	for i := len(names) - 1; i >= 0; i-- {
+		// layer names are not always good file names
+		var src = fmt.Sprintf("data/%03d.png", i)
+		if err := writePNG(archive, src, c.layers[names[i]]); err != nil {
+			return err
+		}
+		stack.Layers = append(stack.Layers, oraLayer{
+			Name:       names[i],
+			Src:        src,
+			Opacity:    "1.0",
+			Visibility: "visible",
+		})
+	}
+	raw, err := xml.MarshalIndent(stack, "", " ")
+	if err != nil {
+		return err
+	}
+	file, err := archive.Create("stack.xml")
+	if err != nil {
+		return err
+	}
+	io.WriteString(file, xml.Header)
+	file.Write(raw)
+
+	var flat = c.Flatten()
+	if err := writePNG(archive, "mergedimage.png", flat); err != nil {
+		return err
+	}
+	if err := writePNG(archive, "Thumbnail/thumbnail.png", thumbnail(flat, ORA_THUMBNAIL_SIZE)); err != nil {
+		return err
+	}
+	return archive.Close()
+}
+
+func writePNG(archive *zip.Writer, name string, img image.Image) error {
+	file, err := archive.Create(name)
+	if err != nil {
+		return err
+	}
+	return png.Encode(file, img)
+}
+
+// thumbnail scales img down to fit in size x size, nearest neighbour.
+func thumbnail(img *image.RGBA, size int) *image.RGBA {
+	var bounds = img.Bounds()
+	var width, height = bounds.Dx(), bounds.Dy()
+	if width <= size && height <= size {
+		return img
+	}
+	var thumbWidth, thumbHeight = size, size
+	if width > height {
+		thumbHeight = height * size / width
+	} else {
+		thumbWidth = width * size / height
+	}
+	if thumbWidth < 1 {
+		thumbWidth = 1
+	}
+	if thumbHeight < 1 {
+		thumbHeight = 1
+	}
+	return resize(img, thumbWidth, thumbHeight)
+}
+
+// Scale resizes img by factor, nearest neighbour.
+func Scale(img *image.RGBA, factor float64) *image.RGBA {
+	if factor == 1 {
+		return img
+	}
+	var width = int(float64(img.Bounds().Dx())*factor + 0.5)
+	var height = int(float64(img.Bounds().Dy())*factor + 0.5)
+	if width < 1 {
+		width = 1
+	}
+	if height < 1 {
+		height = 1
+	}
+	return resize(img, width, height)
+}
+
+func resize(img *image.RGBA, width, height int) *image.RGBA {
+	var bounds = img.Bounds()
+	var result = image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			result.SetRGBA(x, y, img.RGBAAt(bounds.Min.X+x*bounds.Dx()/width, bounds.Min.Y+y*bounds.Dy()/height))
+		}
+	}
+	return result
+}
+
+// SizeOf guesses canvas size of store from layer images, which are in
+// snapshots and at the front of compacted history. ok is false if there's
+// none.
+func SizeOf(store *History.Store) (width, height int, ok bool) {
+	var find = func(frame []byte) error {
+		pkg, err := Socket.DecodeFrame(frame)
+		if err != nil || pkg.PackageType != Socket.DATA {
+			return io.EOF
+		}
+		var action LayerImageAction
+		if json.Unmarshal(pkg.Unpacked, &action) != nil || action.Action != "layerimage" {
+			return io.EOF
+		}
+		raw, err := base64.StdEncoding.DecodeString(action.Image)
+		if err != nil {
+			return nil
+		}
+		config, err := png.DecodeConfig(bytes.NewReader(raw))
+		if err != nil {
+			return nil
+		}
+		// tiles of a layer together cover the canvas
+		var at = pointOf(action.X, action.Y)
+		if at.X+config.Width > width {
+			width = at.X + config.Width
+		}
+		if at.Y+config.Height > height {
+			height = at.Y + config.Height
+		}
+		ok = true
+		return nil
+	}
+	if _, snapshot, err := store.LatestSnapshot(); err == nil && snapshot != nil {
+		History.ReadFrames(bytes.NewReader(snapshot), find)
+	}
+	if !ok {
+		store.Frames(0, store.End(), find)
+	}
+	return
+}
@@ -0,0 +1,134 @@
+package Canvas
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"image"
+	"image/png"
+	"server/pkg/History"
+	"server/pkg/Socket"
+)
+
+func decodeImage(encoded string) (image.Image, error) {
+	raw, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, err
+	}
+	return png.Decode(bytes.NewReader(raw))
+}
+
+func encodeImage(img image.Image) (string, error) {
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(buf.Bytes()), nil
+}
+
+// LayerImageAction replaces a whole layer with a base64 encoded PNG, or
+// only pixels under it if it's a tile at X, Y.
+type LayerImageAction struct {
+	Action string `json:"action"`
+	Layer  string `json:"layer"`
+	Image  string `json:"image"`
+	X      *int   `json:"x,omitempty"`
+	Y      *int   `json:"y,omitempty"`
+}
+
+// Snapshot is layerimage DATA packs of each layer, from bottom to top.
+// Packs are concatenated like in history, so they can be sent as they are.
+// A layer too large for one pack is split into tiles.
+func (c *Canvas) Snapshot() ([]byte, error) {
+	var result []byte
+	for _, name := range c.Layers() {
+		packs, err := c.tiles(name, c.layers[name].Bounds(), Socket.Limits().MaxPackSize)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, packs...)
+	}
+	return result, nil
+}
+
+// tiles encodes rect of layer name, and splits it into quarters until json
+// of each pack is no larger than maxPackSize.
+func (c *Canvas) tiles(name string, rect image.Rectangle, maxPackSize int) ([]byte, error) {
+	var layer = c.layers[name]
+	encoded, err := encodeImage(layer.SubImage(rect))
+	if err != nil {
+		return nil, err
+	}
+	var action = LayerImageAction{
+		Action: "layerimage",
+		Layer:  name,
+		Image:  encoded,
+	}
+	if rect != layer.Bounds() {
+		var x, y = rect.Min.X, rect.Min.Y
+		action.X, action.Y = &x, &y
+	}
+	raw, err := json.Marshal(action)
+	if err != nil {
+		return nil, err
+	}
+	if maxPackSize > 0 && len(raw) > maxPackSize && (rect.Dx() > 1 || rect.Dy() > 1) {
+		var mid = image.Pt((rect.Min.X+rect.Max.X+1)/2, (rect.Min.Y+rect.Max.Y+1)/2)
+		var result []byte
+		for _, part := range []image.Rectangle{
+			image.Rect(rect.Min.X, rect.Min.Y, mid.X, mid.Y),
+			image.Rect(mid.X, rect.Min.Y, rect.Max.X, mid.Y),
+			image.Rect(rect.Min.X, mid.Y, mid.X, rect.Max.Y),
+			image.Rect(mid.X, mid.Y, rect.Max.X, rect.Max.Y),
+		} {
+			if part.Empty() {
+				continue
+			}
+			packs, err := c.tiles(name, part, maxPackSize)
+			if err != nil {
+				return nil, err
+			}
+			result = append(result, packs...)
+		}
+		return result, nil
+	}
+	return Socket.AssamblePack(Socket.PackHeader{
+		Compress: true,
+		PackType: Socket.DATA,
+	}, raw), nil
+}
+
+// Restore renders a snapshot.
+func (c *Canvas) Restore(snapshot []byte) error {
+	return History.ReadFrames(bytes.NewReader(snapshot), c.ApplyFrame)
+}
+
+// Replay renders packs recorded in store from start to end. Packs that
+// cannot be rendered are skipped, like what clients do.
+func (c *Canvas) Replay(store *History.Store, start, end int64) error {
+	return store.Frames(start, end, func(frame []byte) error {
+		c.ApplyFrame(frame)
+		return nil
+	})
+}
+
+// Render rebuilds canvas at end of store, from the latest snapshot if any.
+func Render(store *History.Store, width, height int) (*Canvas, int64, error) {
+	var canvas = NewCanvas(width, height)
+	var end = store.End()
+	offset, snapshot, err := store.LatestSnapshot()
+	if err != nil {
+		return nil, 0, err
+	}
+	if snapshot != nil && offset <= end {
+		if err := canvas.Restore(snapshot); err != nil {
+			return nil, 0, err
+		}
+	} else {
+		offset = 0
+	}
+	if err := canvas.Replay(store, offset, end); err != nil {
+		return nil, 0, err
+	}
+	return canvas, end, nil
+}
@@ -0,0 +1,49 @@
+package Canvas
+
+import (
+	"image"
+	"server/pkg/History"
+	"time"
+)
+
+// TimelapseOptions tell how often a frame is taken. A frame is taken once
+// Interval of recording time passes, or Packs packs are rendered since the
+// last one. 0 disables either.
+type TimelapseOptions struct {
+	Interval time.Duration
+	Packs    int
+}
+
+// Timelapse replays whole history of store, and calls fn with the flattened
+// canvas as frames, and the last one at the end. Time when nobody paints is
+// skipped, so that a frame always shows something new.
+func (c *Canvas) Timelapse(store *History.Store, options TimelapseOptions,
+	fn func(frame *image.RGBA, at time.Time) error) error {
+	var next time.Time
+	var packs int
+	var last time.Time
+	err := store.Packs(0, store.End(), func(entry History.Entry, frame []byte) error {
+		var at = time.Unix(0, entry.Timestamp)
+		if next.IsZero() {
+			next = at.Add(options.Interval)
+		}
+		var timeUp = options.Interval > 0 && !at.Before(next)
+		var packsUp = options.Packs > 0 && packs >= options.Packs
+		if timeUp || packsUp {
+			if err := fn(c.Flatten(), last); err != nil {
+				return err
+			}
+			next = at.Add(options.Interval)
+			packs = 0
+		}
+		// like clients, skip what cannot be rendered
+		c.ApplyFrame(frame)
+		packs++
+		last = at
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return fn(c.Flatten(), last)
+}
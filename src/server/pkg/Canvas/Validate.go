@@ -0,0 +1,78 @@
+package Canvas
+
+import "errors"
+
+const (
+	MAX_BRUSH_WIDTH = 500
+	MAX_LAYER_NAME  = 64
+	MAX_PACK_PIXELS = 1 << 24 // pixels one pack may touch when rendered
+	DAB_SPACING     = 0.25    // of brush radius, between dabs of a line
+)
+
+var (
+	ErrMissingPoint    = errors.New("paint action has no point")
+	ErrOutOfCanvas     = errors.New("point is far outside canvas")
+	ErrInvalidBrush    = errors.New("brush width or color is out of range")
+	ErrInvalidPressure = errors.New("pressure is out of range")
+	ErrInvalidLayer    = errors.New("layer name is empty or too long")
+	ErrTooExpensive    = errors.New("paint action touches too many pixels")
+)
+
+// Validate tells if action can be drawn by a client on a width x height
+// canvas. Points may go outside by one canvas size, since strokes can run
+// over edges. layerimage is for server only.
+func (a *PaintAction) Validate(width, height int) error {
+	var points []Point
+	switch a.Action {
+	case "drawpoint":
+		if a.Point == nil {
+			return ErrMissingPoint
+		}
+		points = []Point{*a.Point}
+	case "drawline":
+		if a.Start == nil || a.End == nil {
+			return ErrMissingPoint
+		}
+		points = []Point{*a.Start, *a.End}
+	case "block":
+		if len(a.Block) == 0 {
+			return ErrMissingPoint
+		}
+		points = a.Block
+	default:
+		return ErrUnknownAction
+	}
+	if len(a.Layer) == 0 || len(a.Layer) > MAX_LAYER_NAME {
+		return ErrInvalidLayer
+	}
+	if !a.Brush.valid() {
+		return ErrInvalidBrush
+	}
+	if !validPressure(a.Pressure) {
+		return ErrInvalidPressure
+	}
+	for _, point := range points {
+		if point.X < -float64(width) || point.X > 2*float64(width) ||
+			point.Y < -float64(height) || point.Y > 2*float64(height) {
+			return ErrOutOfCanvas
+		}
+		if !validPressure(point.Pressure) {
+			return ErrInvalidPressure
+		}
+	}
+	return nil
+}
+
+func (b Brush) valid() bool {
+	return b.Width > 0 && b.Width <= MAX_BRUSH_WIDTH &&
+		validChannel(b.Color.Red) && validChannel(b.Color.Green) && validChannel(b.Color.Blue)
+}
+
+func validChannel(value int) bool {
+	return value >= 0 && value <= 255
+}
+
+// validPressure allows clients without pressure info to omit it.
+func validPressure(pressure *float64) bool {
+	return pressure == nil || (*pressure >= 0 && *pressure <= 1)
+}
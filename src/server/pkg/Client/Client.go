@@ -0,0 +1,203 @@
+// Client is the Go side of painttyWidget, talking to RoomManager and rooms.
+// It's the base of watchDog, bots and load tests.
+package Client
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"net"
+	"server/pkg/Router"
+	"server/pkg/Socket"
+	"sync"
+	"time"
+)
+
+const DEFAULT_TIMEOUT = 10 * time.Second
+
+var (
+	ErrTimeout = errors.New("request timeout")
+	ErrClosed  = errors.New("connection closed")
+)
+
+type PackHandler func(data []byte)
+
+type DisconnectHandler func()
+
+func Dial(addr string) (*Socket.SocketClient, error) {
+	conn, err := net.DialTimeout("tcp", addr, DEFAULT_TIMEOUT)
+	if err != nil {
+		return nil, err
+	}
+	return Socket.MakeSocketClient(conn), nil
+}
+
+func DialTLS(addr string, config *tls.Config) (*Socket.SocketClient, error) {
+	var dialer = &net.Dialer{Timeout: DEFAULT_TIMEOUT}
+	conn, err := tls.DialWithDialer(dialer, "tcp", addr, config)
+	if err != nil {
+		return nil, err
+	}
+	return Socket.MakeSocketClient(conn), nil
+}
+
+// caller matches responses to requests by response name. Server always
+// answers requests of the same name in order, so a queue for each name is
+// enough.
+type caller struct {
+	client     *Socket.SocketClient
+	packType   int
+	Timeout    time.Duration
+	responses  *Router.Router
+	actions    *Router.Router
+	waiters    map[string][]chan []byte
+	locker     sync.Mutex
+	closed     chan bool
+	onData     PackHandler
+	onMessage  PackHandler
+	onClose    DisconnectHandler
+	handlerMux sync.RWMutex
+}
+
+func newCaller(client *Socket.SocketClient, packType int) *caller {
+	var c = &caller{
+		client:    client,
+		packType:  packType,
+		Timeout:   DEFAULT_TIMEOUT,
+		responses: Router.MakeRouter("response"),
+		actions:   Router.MakeRouter("action"),
+		waiters:   make(map[string][]chan []byte),
+		closed:    make(chan bool),
+	}
+	go c.run()
+	return c
+}
+
+func (c *caller) run() {
+	defer func() {
+		close(c.closed)
+		c.handlerMux.RLock()
+		var onClose = c.onClose
+		c.handlerMux.RUnlock()
+		if onClose != nil {
+			onClose()
+		}
+	}()
+	for pkg := range c.client.GetPackageChan() {
+		switch pkg.PackageType {
+		case Socket.DATA:
+			c.handlerMux.RLock()
+			var onData = c.onData
+			c.handlerMux.RUnlock()
+			if onData != nil {
+				onData(pkg.Unpacked)
+			}
+		case Socket.MESSAGE:
+			c.handlerMux.RLock()
+			var onMessage = c.onMessage
+			c.handlerMux.RUnlock()
+			if onMessage != nil {
+				onMessage(pkg.Unpacked)
+			}
+		case c.packType:
+			c.dispatch(pkg.Unpacked)
+		}
+	}
+}
+
+func (c *caller) dispatch(data []byte) {
+	var head struct {
+		Response string `json:"response"`
+		Action   string `json:"action"`
+	}
+	if err := json.Unmarshal(data, &head); err != nil {
+		return
+	}
+	if len(head.Response) > 0 {
+		c.locker.Lock()
+		var queue = c.waiters[head.Response]
+		if len(queue) > 0 {
+			c.waiters[head.Response] = queue[1:]
+		}
+		c.locker.Unlock()
+		if len(queue) > 0 {
+			queue[0] <- data
+		}
+		c.responses.OnMessage(data, c.client)
+		return
+	}
+	if len(head.Action) > 0 {
+		c.actions.OnMessage(data, c.client)
+	}
+}
+
+func (c *caller) send(req interface{}) error {
+	raw, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+	switch c.packType {
+	case Socket.MANAGER:
+		_, err = c.client.SendManagerPack(raw)
+	default:
+		_, err = c.client.SendCommandPack(raw)
+	}
+	return err
+}
+
+// call sends req, and waits for response named name, which is decoded into
+// resp.
+func (c *caller) call(req interface{}, name string, resp interface{}) error {
+	var waiter = make(chan []byte, 1)
+	c.locker.Lock()
+	c.waiters[name] = append(c.waiters[name], waiter)
+	c.locker.Unlock()
+
+	if err := c.send(req); err != nil {
+		c.removeWaiter(name, waiter)
+		return err
+	}
+
+	select {
+	case data := <-waiter:
+		return json.Unmarshal(data, resp)
+	case _, _ = <-c.closed:
+		return ErrClosed
+	case <-time.After(c.Timeout):
+		c.removeWaiter(name, waiter)
+		return ErrTimeout
+	}
+}
+
+func (c *caller) removeWaiter(name string, waiter chan []byte) {
+	c.locker.Lock()
+	defer c.locker.Unlock()
+	var queue = c.waiters[name]
+	for i, item := range queue {
+		if item == waiter {
+			c.waiters[name] = append(queue[:i], queue[i+1:]...)
+			return
+		}
+	}
+}
+
+func (c *caller) onAction(action string, handler PackHandler) {
+	c.actions.Register(action, func(data []byte, _ *Socket.SocketClient) {
+		handler(data)
+	})
+}
+
+// OnDisconnect is called once connection is closed by either side.
+func (c *caller) OnDisconnect(handler DisconnectHandler) {
+	c.handlerMux.Lock()
+	defer c.handlerMux.Unlock()
+	c.onClose = handler
+}
+
+func (c *caller) Socket() *Socket.SocketClient {
+	return c.client
+}
+
+func (c *caller) Close() {
+	c.client.Close()
+}
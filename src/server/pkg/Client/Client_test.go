@@ -0,0 +1,150 @@
+package Client
+
+import "testing"
+import "bytes"
+import "encoding/json"
+import "net"
+import "server/pkg/Socket"
+import "time"
+
+// fakeServer answers every request with reply(request name).
+func fakeServer(t *testing.T, reply func(server *Socket.SocketClient, request string)) *Socket.SocketClient {
+	serverConn, clientConn := net.Pipe()
+	var server = Socket.MakeSocketClient(serverConn)
+	go func() {
+		for pkg := range server.GetPackageChan() {
+			var req map[string]interface{}
+			if err := json.Unmarshal(pkg.Unpacked, &req); err != nil {
+				t.Error(err)
+				continue
+			}
+			name, _ := req["request"].(string)
+			reply(server, name)
+		}
+	}()
+	return Socket.MakeSocketClient(clientConn)
+}
+
+func TestRoomList(t *testing.T) {
+	var client = NewManagerClient(fakeServer(t, func(server *Socket.SocketClient, request string) {
+		if request != "roomlist" {
+			t.Error("unexpected request", request)
+		}
+		server.SendManagerPack([]byte(`{"response":"roomlist","result":true,"roomlist":[{"name":"test","port":1234}]}`))
+	}))
+	defer client.Close()
+
+	resp, err := client.RoomList()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !resp.Result || len(resp.RoomList) != 1 || resp.RoomList[0].Name != "test" || resp.RoomList[0].Port != 1234 {
+		t.Error("unexpected room list", resp)
+	}
+}
+
+func TestTimeout(t *testing.T) {
+	var client = NewManagerClient(fakeServer(t, func(server *Socket.SocketClient, request string) {
+	}))
+	defer client.Close()
+	client.Timeout = 100 * time.Millisecond
+
+	if _, err := client.RoomList(); err != ErrTimeout {
+		t.Error("request without response should time out", err)
+	}
+}
+
+func TestLoginAndActions(t *testing.T) {
+	var client = NewRoomClient(fakeServer(t, func(server *Socket.SocketClient, request string) {
+		switch request {
+		case "login":
+			server.SendCommandPack([]byte(`{"response":"login","result":true,"info":{"clientid":"abc"}}`))
+			server.SendCommandPack([]byte(`{"action":"notify","content":"hi"}`))
+			server.SendDataPack([]byte(`{"action":"block"}`))
+			server.SendCommandPack([]byte(`{"action":"kick"}`))
+		}
+	}))
+	defer client.Close()
+
+	var notified = make(chan string, 1)
+	var data = make(chan string, 1)
+	var kicked = make(chan bool, 1)
+	client.OnNotify(func(content string) {
+		notified <- content
+	})
+	client.OnData(func(raw []byte) {
+		data <- string(raw)
+	})
+	client.OnKick(func() {
+		kicked <- true
+	})
+
+	resp, err := client.Login("someone", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !resp.Result || client.ClientId() != "abc" {
+		t.Error("unexpected login response", resp)
+	}
+
+	for i := 0; i < 3; i++ {
+		select {
+		case content := <-notified:
+			if content != "hi" {
+				t.Error("unexpected notify", content)
+			}
+		case raw := <-data:
+			if raw != `{"action":"block"}` {
+				t.Error("unexpected data", raw)
+			}
+		case <-kicked:
+		case <-time.After(5 * time.Second):
+			t.Fatal("callbacks are not called")
+		}
+	}
+}
+
+func TestDisconnect(t *testing.T) {
+	var client = NewRoomClient(fakeServer(t, func(server *Socket.SocketClient, request string) {
+		server.Close()
+	}))
+	var disconnected = make(chan bool, 1)
+	client.OnDisconnect(func() {
+		disconnected <- true
+	})
+
+	if _, err := client.ArchiveSign(); err != ErrClosed {
+		t.Error("pending request should fail once connection closed", err)
+	}
+	select {
+	case <-disconnected:
+	case <-time.After(5 * time.Second):
+		t.Error("OnDisconnect is not called")
+	}
+}
+
+func TestDownloadExport(t *testing.T) {
+	var pieces = []string{
+		`{"response":"export","result":true,"offset":0,"size":6,"data":"YWJj"}`,
+		`{"response":"export","result":true,"offset":3,"size":6,"data":"ZGVm"}`,
+		`{"response":"export","result":false,"errcode":1002}`,
+	}
+	var client = NewRoomClient(fakeServer(t, func(server *Socket.SocketClient, request string) {
+		if request == "export" {
+			server.SendCommandPack([]byte(pieces[0]))
+			pieces = pieces[1:]
+		}
+	}))
+	defer client.Close()
+
+	var buf bytes.Buffer
+	if err := client.DownloadExport("key", "png", &buf); err != nil {
+		t.Fatal(err)
+	}
+	if buf.String() != "abcdef" {
+		t.Error("unexpected export", buf.String())
+	}
+	if err := client.DownloadExport("key", "psd", &buf); err == nil {
+		t.Error("failed export should be reported")
+	}
+}
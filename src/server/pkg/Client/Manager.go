@@ -0,0 +1,50 @@
+package Client
+
+import (
+	"server/pkg/RoomManager"
+	"server/pkg/Socket"
+)
+
+type ManagerClient struct {
+	*caller
+}
+
+func NewManagerClient(client *Socket.SocketClient) *ManagerClient {
+	return &ManagerClient{newCaller(client, Socket.MANAGER)}
+}
+
+func DialManager(addr string) (*ManagerClient, error) {
+	client, err := Dial(addr)
+	if err != nil {
+		return nil, err
+	}
+	return NewManagerClient(client), nil
+}
+
+func (c *ManagerClient) Hello(version int, clientVersion string, capabilities []string) (*Socket.HelloResponse, error) {
+	var resp = &Socket.HelloResponse{}
+	err := c.call(Socket.HelloRequest{
+		Request:       "hello",
+		Version:       version,
+		ClientVersion: clientVersion,
+		Capabilities:  capabilities,
+	}, "hello", resp)
+	return resp, err
+}
+
+func (c *ManagerClient) RoomList() (*RoomManager.RoomListResponse, error) {
+	var resp = &RoomManager.RoomListResponse{}
+	err := c.call(RoomManager.RoomListRequest{
+		Request: "roomlist",
+	}, "roomlist", resp)
+	return resp, err
+}
+
+func (c *ManagerClient) NewRoom(info RoomManager.NewRoomInfoForRequest) (*RoomManager.NewRoomResponse, error) {
+	var resp = &RoomManager.NewRoomResponse{}
+	err := c.call(RoomManager.NewRoomRequest{
+		Request: "newroom",
+		Info:    info,
+	}, "newroom", resp)
+	return resp, err
+}
@@ -0,0 +1,353 @@
+package Client
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"server/pkg/Room"
+	"server/pkg/Socket"
+	"time"
+)
+
+type RoomClient struct {
+	*caller
+	clientId string
+}
+
+func NewRoomClient(client *Socket.SocketClient) *RoomClient {
+	return &RoomClient{caller: newCaller(client, Socket.COMMAND)}
+}
+
+func DialRoom(addr string) (*RoomClient, error) {
+	client, err := Dial(addr)
+	if err != nil {
+		return nil, err
+	}
+	return NewRoomClient(client), nil
+}
+
+// ClientId is the one server gave us at login.
+func (c *RoomClient) ClientId() string {
+	return c.clientId
+}
+
+func (c *RoomClient) Hello(version int, clientVersion string, capabilities []string) (*Socket.HelloResponse, error) {
+	var resp = &Socket.HelloResponse{}
+	err := c.call(Socket.HelloRequest{
+		Request:       "hello",
+		Version:       version,
+		ClientVersion: clientVersion,
+		Capabilities:  capabilities,
+	}, "hello", resp)
+	return resp, err
+}
+
+// Login joins room. room is only required on shared room port.
+func (c *RoomClient) Login(name, password, room string) (*Room.JoinRoomResponse, error) {
+	var resp = &Room.JoinRoomResponse{}
+	err := c.call(Room.JoinRoomRequest{
+		Request:  "login",
+		Password: password,
+		Name:     name,
+		Room:     room,
+	}, "login", resp)
+	if err == nil && resp.Result {
+		c.clientId = resp.RoomList.ClientId
+	}
+	return resp, err
+}
+
+// Heartbeat is only answered after Archive, since server replies it in the
+// same queue as archive data.
+func (c *RoomClient) Heartbeat(timestamp int64) (*Room.HeartbeatResponse, error) {
+	var resp = &Room.HeartbeatResponse{}
+	err := c.call(Room.HeartbeatRequest{
+		Request:   "heartbeat",
+		Timestamp: timestamp,
+	}, "heartbeat", resp)
+	return resp, err
+}
+
+func (c *RoomClient) ArchiveSign() (*Room.ArchiveSignResponse, error) {
+	var resp = &Room.ArchiveSignResponse{}
+	err := c.call(Room.ArchiveSignRequest{
+		Request: "archivesign",
+	}, "archivesign", resp)
+	return resp, err
+}
+
+// Archive asks for history from start, length 0 means all of it. History
+// comes in DATA packs afterwards, see OnData.
+func (c *RoomClient) Archive(start, length int64) (*Room.ArchiveResponse, error) {
+	var resp = &Room.ArchiveResponse{}
+	err := c.call(Room.ArchiveRequest{
+		Request:    "archive",
+		Start:      start,
+		DataLength: length,
+	}, "archive", resp)
+	return resp, err
+}
+
+// ArchiveSnapshot asks for the latest snapshot, which comes in layerimage
+// DATA packs, and history after it. Server sends history from start as
+// Archive does if snapshot doesn't help.
+func (c *RoomClient) ArchiveSnapshot(start int64) (*Room.ArchiveResponse, error) {
+	var resp = &Room.ArchiveResponse{}
+	err := c.call(Room.ArchiveRequest{
+		Request:  "archive",
+		Start:    start,
+		Snapshot: true,
+	}, "archive", resp)
+	return resp, err
+}
+
+func (c *RoomClient) OnlineList() (*Room.OnlineListResponse, error) {
+	var resp = &Room.OnlineListResponse{}
+	err := c.call(Room.OnlineListRequest{
+		Request:  "onlinelist",
+		ClientId: c.clientId,
+	}, "onlinelist", resp)
+	return resp, err
+}
+
+func (c *RoomClient) ClearAll(key string) (*Room.ClearAllResponse, error) {
+	var resp = &Room.ClearAllResponse{}
+	err := c.call(Room.ClearAllRequest{
+		Request: "clearall",
+		Key:     key,
+	}, "clearall", resp)
+	return resp, err
+}
+
+// Rollback asks server to drop history recorded after at.
+func (c *RoomClient) Rollback(key string, at time.Time) (*Room.RollbackResponse, error) {
+	var resp = &Room.RollbackResponse{}
+	err := c.call(Room.RollbackRequest{
+		Request:   "rollback",
+		Key:       key,
+		Timestamp: at.Unix(),
+	}, "rollback", resp)
+	return resp, err
+}
+
+// ClearLayer asks server to remove strokes of layer from history.
+func (c *RoomClient) ClearLayer(key, layer string) (*Room.ClearLayerResponse, error) {
+	var resp = &Room.ClearLayerResponse{}
+	err := c.call(Room.ClearLayerRequest{
+		Request: "clearlayer",
+		Key:     key,
+		Layer:   layer,
+	}, "clearlayer", resp)
+	return resp, err
+}
+
+// Undo asks server to withdraw the latest stroke of this client.
+func (c *RoomClient) Undo() (*Room.UndoResponse, error) {
+	var resp = &Room.UndoResponse{}
+	err := c.call(Room.UndoRequest{
+		Request: "undo",
+	}, "undo", resp)
+	return resp, err
+}
+
+// PurgeUser asks server to remove everything drawn by a user, found by
+// clientId, or by name if clientId is empty.
+func (c *RoomClient) PurgeUser(key, clientId, name string) (*Room.PurgeUserResponse, error) {
+	var resp = &Room.PurgeUserResponse{}
+	err := c.call(Room.PurgeUserRequest{
+		Request:  "purgeuser",
+		Key:      key,
+		ClientId: clientId,
+		Name:     name,
+	}, "purgeuser", resp)
+	return resp, err
+}
+
+// Compact asks server to replace history with a rendered baseline. It may
+// take longer than Timeout for a large history.
+func (c *RoomClient) Compact(key string) (*Room.CompactResponse, error) {
+	var resp = &Room.CompactResponse{}
+	err := c.call(Room.CompactRequest{
+		Request: "compact",
+		Key:     key,
+	}, "compact", resp)
+	return resp, err
+}
+
+// Export asks for a piece of exported canvas from offset. Canvas is rendered
+// again when offset is 0.
+func (c *RoomClient) Export(key, format string, offset int64) (*Room.ExportResponse, error) {
+	var resp = &Room.ExportResponse{}
+	err := c.call(Room.ExportRequest{
+		Request: "export",
+		Key:     key,
+		Format:  format,
+		Offset:  offset,
+	}, "export", resp)
+	return resp, err
+}
+
+// DownloadExport renders canvas in format, and writes all of it to w.
+func (c *RoomClient) DownloadExport(key, format string, w io.Writer) error {
+	var offset int64
+	for {
+		resp, err := c.Export(key, format, offset)
+		if err != nil {
+			return err
+		}
+		if !resp.Result {
+			return fmt.Errorf("export failed with errcode %d", resp.Errcode)
+		}
+		piece, err := base64.StdEncoding.DecodeString(resp.Data)
+		if err != nil {
+			return err
+		}
+		if _, err := w.Write(piece); err != nil {
+			return err
+		}
+		offset += int64(len(piece))
+		if offset >= resp.Size || len(piece) == 0 {
+			return nil
+		}
+	}
+}
+
+func (c *RoomClient) Kick(key, clientId string) (*Room.KickResponse, error) {
+	var resp = &Room.KickResponse{}
+	err := c.call(Room.KickRequest{
+		Request:  "kick",
+		Key:      key,
+		ClientId: clientId,
+	}, "kick", resp)
+	return resp, err
+}
+
+// CloseRoom asks server to close room once everyone leaves.
+func (c *RoomClient) CloseRoom(key string) (*Room.CloseResponse, error) {
+	var resp = &Room.CloseResponse{}
+	err := c.call(Room.CloseRequest{
+		Request: "close",
+		Key:     key,
+	}, "close", resp)
+	return resp, err
+}
+
+func (c *RoomClient) Checkout(key string) (*Room.CheckoutResponse, error) {
+	var resp = &Room.CheckoutResponse{}
+	err := c.call(Room.CheckoutRequest{
+		Request: "checkout",
+		Key:     key,
+	}, "checkout", resp)
+	return resp, err
+}
+
+// SendData sends a painting action, which is json.
+func (c *RoomClient) SendData(data []byte) error {
+	_, err := c.client.SendDataPack(data)
+	return err
+}
+
+// SendMessage sends a text message, which is json.
+func (c *RoomClient) SendMessage(data []byte) error {
+	_, err := c.client.SendMessagePack(data)
+	return err
+}
+
+// OnData is called for each painting action, archive included.
+func (c *RoomClient) OnData(handler PackHandler) {
+	c.handlerMux.Lock()
+	defer c.handlerMux.Unlock()
+	c.onData = handler
+}
+
+// OnMessage is called for each text message.
+func (c *RoomClient) OnMessage(handler PackHandler) {
+	c.handlerMux.Lock()
+	defer c.handlerMux.Unlock()
+	c.onMessage = handler
+}
+
+// OnAction is called for actions server sends, with the raw json.
+func (c *RoomClient) OnAction(action string, handler PackHandler) {
+	c.onAction(action, handler)
+}
+
+func (c *RoomClient) OnKick(handler func()) {
+	c.onAction("kick", func(_ []byte) {
+		handler()
+	})
+}
+
+func (c *RoomClient) OnClose(handler func(reason int64)) {
+	c.onAction("close", func(data []byte) {
+		var action = Room.CloseAction{}
+		json.Unmarshal(data, &action)
+		handler(action.Info.Reason)
+	})
+}
+
+func (c *RoomClient) OnClearAll(handler func(signature string)) {
+	c.onAction("clearall", func(data []byte) {
+		var action = Room.ClearAllAction{}
+		json.Unmarshal(data, &action)
+		handler(action.Signature)
+	})
+}
+
+// OnRollback is called once history is rolled back, and archive should be
+// downloaded again.
+func (c *RoomClient) OnRollback(handler func(at time.Time, signature string)) {
+	c.onAction("rollback", func(data []byte) {
+		var action = Room.RollbackAction{}
+		json.Unmarshal(data, &action)
+		handler(time.Unix(action.Timestamp, 0), action.Signature)
+	})
+}
+
+// OnClearLayer is called once layer is removed from history.
+func (c *RoomClient) OnClearLayer(handler func(layer, signature string)) {
+	c.onAction("clearlayer", func(data []byte) {
+		var action = Room.ClearLayerAction{}
+		json.Unmarshal(data, &action)
+		handler(action.Layer, action.Signature)
+	})
+}
+
+// OnUndo is called once a stroke of userId is withdrawn. id is where the
+// stroke was in archive of the old signature.
+func (c *RoomClient) OnUndo(handler func(userId string, id int64, signature string)) {
+	c.onAction("undo", func(data []byte) {
+		var action = Room.UndoAction{}
+		json.Unmarshal(data, &action)
+		handler(action.UserId, action.Id, action.Signature)
+	})
+}
+
+// OnPurgeUser is called once strokes of a user are purged, and archive
+// should be downloaded again.
+func (c *RoomClient) OnPurgeUser(handler func(clientId, name, signature string)) {
+	c.onAction("purgeuser", func(data []byte) {
+		var action = Room.PurgeUserAction{}
+		json.Unmarshal(data, &action)
+		handler(action.ClientId, action.Name, action.Signature)
+	})
+}
+
+// OnCompact is called once history is compacted, and archive should be
+// downloaded again.
+func (c *RoomClient) OnCompact(handler func(signature string)) {
+	c.onAction("compact", func(data []byte) {
+		var action = Room.CompactAction{}
+		json.Unmarshal(data, &action)
+		handler(action.Signature)
+	})
+}
+
+func (c *RoomClient) OnNotify(handler func(content string)) {
+	c.onAction("notify", func(data []byte) {
+		var action = Room.NotifyAction{}
+		json.Unmarshal(data, &action)
+		handler(action.Content)
+	})
+}
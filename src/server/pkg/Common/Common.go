@@ -1,6 +1,7 @@
 package Common
 
 import "bytes"
+import "errors"
 import "compress/zlib"
 import "io"
 
@@ -24,7 +25,15 @@ func QCompress(data []byte) ([]byte, error) {
 	return tmp.Bytes(), nil
 }
 
+var ErrUncompressedTooLarge = errors.New("uncompressed data exceeds size limit")
+
 func QUncompress(data []byte) (result []byte, err error) {
+	return QUncompressLimit(data, 0)
+}
+
+// QUncompressLimit refuses to produce more than limit bytes, no matter what
+// size header says. limit <= 0 means no limit.
+func QUncompressLimit(data []byte, limit int) (result []byte, err error) {
 	defer func() {
 		// recover from panic if one occured. Set err to nil otherwise.
 		if e := recover(); e != nil {
@@ -32,14 +41,28 @@ func QUncompress(data []byte) (result []byte, err error) {
 			result = []byte{}
 		}
 	}()
+	if limit > 0 && len(data) >= 4 {
+		var claimed = int64(data[0])<<24 | int64(data[1])<<16 | int64(data[2])<<8 | int64(data[3])
+		if claimed > int64(limit) {
+			return []byte{}, ErrUncompressedTooLarge
+		}
+	}
 	var resized = bytes.NewBuffer(data[4:])
 	var tmp bytes.Buffer
 	r, err := zlib.NewReader(resized)
 	if err != nil {
 		return []byte{}, err
 	}
+	defer r.Close()
+	if limit > 0 {
+		// header can lie, so count what actually comes out
+		n, _ := io.Copy(&tmp, io.LimitReader(r, int64(limit)+1))
+		if n > int64(limit) {
+			return []byte{}, ErrUncompressedTooLarge
+		}
+		return tmp.Bytes(), nil
+	}
 	io.Copy(&tmp, r)
-	r.Close()
 
 	return tmp.Bytes(), nil
 }
@@ -62,3 +62,28 @@ func TestQCompress3(t *testing.T) {
 		t.Error("cannot recover or detect invalid input")
 	}
 }
+
+func TestQUncompressLimit(t *testing.T) {
+	var bomb = make([]byte, 1024*1024)
+	var compressed, err = QCompress(bomb)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	result, err := QUncompressLimit(compressed, len(bomb))
+	if err != nil || len(result) != len(bomb) {
+		t.Error("data within limit should be uncompressed", len(result), err)
+	}
+
+	_, err = QUncompressLimit(compressed, 1024)
+	if err != ErrUncompressedTooLarge {
+		t.Error("size header beyond limit should be rejected", err)
+	}
+
+	// lie about size in header
+	compressed[0], compressed[1], compressed[2], compressed[3] = 0, 0, 0, 1
+	_, err = QUncompressLimit(compressed, 1024)
+	if err != ErrUncompressedTooLarge {
+		t.Error("real size beyond limit should be rejected", err)
+	}
+}
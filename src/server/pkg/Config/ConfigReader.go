@@ -7,7 +7,10 @@ import (
 	"log"
 	"os"
 	"path/filepath"
+	"server/pkg/Radio"
+	"server/pkg/Socket"
 	"sync"
+	"time"
 )
 
 var confMap sync.Map
@@ -73,6 +76,18 @@ func applyDefaultSimpleConfigValues(confs *sync.Map) {
 	applyDefaultInt(confs, "expiration", 48)
 	applyDefaultInt(confs, "max_load", 8)
 	applyDefaultInt(confs, "max_room_count", 1000)
+	applyDefaultInt(confs, "max_pack_size", Socket.DEFAULT_MAX_PACK_SIZE)
+	applyDefaultInt(confs, "max_uncompressed_size", Socket.DEFAULT_MAX_UNCOMPRESSED_SIZE)
+	applyDefaultInt(confs, "read_timeout", int(Socket.DEFAULT_READ_TIMEOUT/time.Second))
+	applyDefaultInt(confs, "write_timeout", int(Socket.DEFAULT_WRITE_TIMEOUT/time.Second))
+	applyDefaultInt(confs, "max_queue_bytes", int(Radio.DEFAULT_MAX_QUEUE_BYTES))
+	applyDefaultInt(confs, "max_queue_chunks", Radio.DEFAULT_MAX_QUEUE_CHUNKS)
+	applyDefaultString(confs, "slow_client_policy", Radio.SLOW_CLIENT_DROP)
+	applyDefaultInt(confs, "snapshot_interval", 4*1024*1024)
+	applyDefaultInt(confs, "compact_threshold", 0)
+	applyDefaultInt(confs, "max_rejected_packs", 16)
+	applyDefaultInt(confs, "undo_interval", 1000)
+	applyDefaultInt(confs, "export_retention", 168)
 }
 
 func createSaltFile() []byte {
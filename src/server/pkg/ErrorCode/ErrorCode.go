@@ -15,7 +15,18 @@ const (
 	LOGIN_INVALID_NAME          = 301
 	LOGIN_PWD_INCORRECT         = 302
 	LOGIN_ROOM_IS_FULL          = 303
+	LOGIN_ROOM_NOT_FOUND        = 306
 	CHECKOUT_UNKNOWN            = 700
 	CHECKOUT_KEY_INCORRECT      = 701
 	CHECKOUT_TIMEOUT            = 702
+	DISCONNECT_SLOW_CLIENT      = 800
+	EXPORT_UNKNOWN              = 1000
+	EXPORT_KEY_INCORRECT        = 1001
+	EXPORT_INVALID_FORMAT       = 1002
+	EXPORT_OUT_OF_RANGE         = 1003
+	EXPORT_BUSY                 = 1004
+	UNDO_UNKNOWN                = 1100
+	UNDO_NOTHING                = 1101
+	UNDO_TOO_FAST               = 1102
+	UNDO_BUSY                   = 1103
 )
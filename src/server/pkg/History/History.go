@@ -0,0 +1,259 @@
+// History is an append-only store of packs recorded in a room.
+// Packs are kept in fixed-size segment files, and an index records where and
+// when each pack was written. Offsets are logical, as if all segments were
+// one file, so they match offsets of the old single .data file.
+package History
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	DEFAULT_SEGMENT_SIZE int64 = 16 * 1024 * 1024 // Bytes
+	SEGMENT_SUFFIX             = ".seg"
+)
+
+var ErrOutOfRange = errors.New("read beyond history")
+var ErrClosed = errors.New("history is closed")
+
+type Store struct {
+	dir         string
+	segmentSize int64
+	segments    []*os.File
+	index       *Index
+	size        int64
+	syncWrites  bool
+	locker      sync.RWMutex
+}
+
+func segmentName(dir string, seq int) string {
+	return filepath.Join(dir, fmt.Sprintf("%08d%s", seq, SEGMENT_SUFFIX))
+}
+
+// Open opens store in dir, or creates an empty one. segmentSize only
+// applies to new stores, existing ones keep what they're created with.
+// Index entries beyond the recorded bytes are dropped, but bytes after the
+// last indexed pack are kept as they are; Repair indexes or truncates them.
+func Open(dir string, segmentSize int64) (*Store, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	s, err := open(dir, segmentSize, os.O_RDWR)
+	if err != nil {
+		return nil, err
+	}
+	s.index.dropAfter(s.size)
+	return s, nil
+}
+
+// OpenReadOnly opens an existing store, and never changes it.
+func OpenReadOnly(dir string) (*Store, error) {
+	if _, err := os.Stat(filepath.Join(dir, INDEX_FILE_NAME)); err != nil {
+		return nil, err
+	}
+	return open(dir, DEFAULT_SEGMENT_SIZE, os.O_RDONLY)
+}
+
+func open(dir string, segmentSize int64, flag int) (*Store, error) {
+	index, err := openIndex(dir, segmentSize, flag)
+	if err != nil {
+		return nil, err
+	}
+	var s = &Store{
+		dir:         dir,
+		segmentSize: index.segmentSize,
+		segments:    make([]*os.File, 0),
+		index:       index,
+		syncWrites:  true,
+	}
+	if err := s.openSegments(flag); err != nil {
+		s.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *Store) openSegments(flag int) error {
+	for seq := 0; ; seq++ {
+		var name = segmentName(s.dir, seq)
+		fi, err := os.Stat(name)
+		if os.IsNotExist(err) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if seq > 0 && s.size != int64(seq)*s.segmentSize {
+			return fmt.Errorf("segment %d is not full, but followed by %s", seq-1, name)
+		}
+		file, err := os.OpenFile(name, flag, 0644)
+		if err != nil {
+			return err
+		}
+		s.segments = append(s.segments, file)
+		s.size += fi.Size()
+	}
+}
+
+func (s *Store) Dir() string {
+	return s.dir
+}
+
+// Size is the logical size of history in bytes.
+func (s *Store) Size() int64 {
+	return atomic.LoadInt64(&s.size)
+}
+
+// Entries are all recorded packs in order.
+func (s *Store) Entries() []Entry {
+	s.locker.RLock()
+	defer s.locker.RUnlock()
+	return s.index.copyEntries()
+}
+
+// SetSyncWrites turns on or off syncing on each write, which is on by
+// default. Turn it off for stores filled in bulk and synced at the end,
+// since syncing each pack makes them much slower.
+func (s *Store) SetSyncWrites(on bool) {
+	s.locker.Lock()
+	defer s.locker.Unlock()
+	s.syncWrites = on
+}
+
+// Write records one pack, and returns its offset.
+func (s *Store) Write(data []byte) (int64, error) {
+	return s.WriteAt(data, time.Now())
+}
+
+// WriteAt records one pack as if it's written at timestamp. Bytes of the pack
+// are synced to disk before it's indexed, so that a crash never leaves the
+// index ahead of segments, at the cost of one fsync per pack. The index
+// itself is only synced by Sync and Close; entries it loses in a crash are
+// found again by Repair.
+func (s *Store) WriteAt(data []byte, timestamp time.Time) (int64, error) {
+	s.locker.Lock()
+	defer s.locker.Unlock()
+	var offset = s.size
+	var written int64
+	for written < int64(len(data)) {
+		var pos = offset + written
+		var seq = int(pos / s.segmentSize)
+		var inSegment = pos % s.segmentSize
+		if seq >= len(s.segments) {
+			file, err := os.OpenFile(segmentName(s.dir, seq), os.O_RDWR|os.O_CREATE, 0644)
+			if err != nil {
+				return offset, err
+			}
+			s.segments = append(s.segments, file)
+		}
+		var part = data[written:]
+		if int64(len(part)) > s.segmentSize-inSegment {
+			part = part[:s.segmentSize-inSegment]
+		}
+		n, err := s.segments[seq].WriteAt(part, inSegment)
+		written += int64(n)
+		atomic.AddInt64(&s.size, int64(n))
+		if err != nil {
+			return offset, err
+		}
+	}
+	if s.syncWrites {
+		for seq := int(offset / s.segmentSize); seq < len(s.segments); seq++ {
+			if err := s.segments[seq].Sync(); err != nil {
+				return offset, err
+			}
+		}
+	}
+	err := s.index.append(Entry{
+		Offset:    offset,
+		Length:    int64(len(data)),
+		Timestamp: timestamp.UnixNano(),
+	})
+	return offset, err
+}
+
+// ReadAt reads len(buf) bytes from off, and fails if history is not so long.
+func (s *Store) ReadAt(buf []byte, off int64) (int, error) {
+	s.locker.RLock()
+	defer s.locker.RUnlock()
+	if off < 0 || off+int64(len(buf)) > s.size {
+		return 0, ErrOutOfRange
+	}
+	var read int
+	for read < len(buf) {
+		var pos = off + int64(read)
+		var seq = int(pos / s.segmentSize)
+		if seq >= len(s.segments) {
+			return read, ErrClosed // by Close or Remove
+		}
+		var part = buf[read:]
+		if int64(len(part)) > s.segmentSize-pos%s.segmentSize {
+			part = part[:s.segmentSize-pos%s.segmentSize]
+		}
+		n, err := s.segments[seq].ReadAt(part, pos%s.segmentSize)
+		read += n
+		if err != nil && err != io.EOF {
+			return read, err
+		}
+		if n < len(part) {
+			return read, io.ErrUnexpectedEOF
+		}
+	}
+	return read, nil
+}
+
+// Sync commits segments and index to disk.
+func (s *Store) Sync() error {
+	s.locker.RLock()
+	defer s.locker.RUnlock()
+	return s.sync()
+}
+
+func (s *Store) sync() error {
+	for _, file := range s.segments {
+		if err := file.Sync(); err != nil {
+			return err
+		}
+	}
+	return s.index.sync()
+}
+
+// Close syncs and closes store.
+func (s *Store) Close() error {
+	s.locker.Lock()
+	defer s.locker.Unlock()
+	var result = s.sync()
+	if err := s.close(); err != nil && result == nil {
+		result = err
+	}
+	return result
+}
+
+func (s *Store) close() error {
+	var result error
+	for _, file := range s.segments {
+		if err := file.Close(); err != nil && result == nil {
+			result = err
+		}
+	}
+	s.segments = nil
+	if err := s.index.close(); err != nil && result == nil {
+		result = err
+	}
+	return result
+}
+
+// Remove closes store and removes everything of it.
+func (s *Store) Remove() error {
+	s.locker.Lock()
+	s.close()
+	s.locker.Unlock()
+	return os.RemoveAll(s.dir)
+}
@@ -0,0 +1,352 @@
+package History
+
+import "testing"
+
+import "bytes"
+import "io/ioutil"
+import "os"
+import "path/filepath"
+import "time"
+
+func tempDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "history")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+// frame makes a pack like what is recorded, size header included.
+func frame(body string) []byte {
+	var size = len(body)
+	return append([]byte{byte(size >> 24), byte(size >> 16), byte(size >> 8), byte(size)}, body...)
+}
+
+func TestWriteAndRead(t *testing.T) {
+	var dir = tempDir(t)
+	defer os.RemoveAll(dir)
+
+	store, err := Open(filepath.Join(dir, "store"), 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var whole []byte
+	for _, body := range []string{"a", "0123456789abcdef", "xyz"} {
+		var pack = frame(body)
+		offset, err := store.Write(pack)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if offset != int64(len(whole)) {
+			t.Error("unexpected offset", offset, len(whole))
+		}
+		whole = append(whole, pack...)
+	}
+	if store.Size() != int64(len(whole)) {
+		t.Error("unexpected size", store.Size())
+	}
+
+	// read across segments
+	var buf = make([]byte, 15)
+	if _, err := store.ReadAt(buf, 3); err != nil || !bytes.Equal(buf, whole[3:18]) {
+		t.Error("unexpected read", buf, err)
+	}
+	if _, err := store.ReadAt(buf, int64(len(whole))-10); err != ErrOutOfRange {
+		t.Error("read beyond history should fail", err)
+	}
+
+	// reopen with a different segment size, which is ignored
+	store.Close()
+	store, err = Open(filepath.Join(dir, "store"), 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	if store.Size() != int64(len(whole)) {
+		t.Error("unexpected size after reopen", store.Size())
+	}
+	buf = make([]byte, len(whole))
+	if _, err := store.ReadAt(buf, 0); err != nil || !bytes.Equal(buf, whole) {
+		t.Error("unexpected read after reopen", err)
+	}
+	var entries = store.Entries()
+	if len(entries) != 3 || entries[1].Offset != 5 || entries[1].Length != 20 || entries[2].Offset != 25 {
+		t.Error("unexpected entries", entries)
+	}
+}
+
+func TestPartialIndexEntry(t *testing.T) {
+	var dir = tempDir(t)
+	defer os.RemoveAll(dir)
+
+	store, err := Open(dir, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.Write(frame("hello"))
+	store.Close()
+
+	var name = filepath.Join(dir, INDEX_FILE_NAME)
+	file, _ := os.OpenFile(name, os.O_WRONLY|os.O_APPEND, 0644)
+	file.Write([]byte{1, 2, 3})
+	file.Close()
+
+	store, err = Open(dir, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	if len(store.Entries()) != 1 {
+		t.Error("partial entry should be dropped", store.Entries())
+	}
+	if fi, _ := os.Stat(name); fi.Size() != INDEX_HEADER_LEN+INDEX_ENTRY_LEN {
+		t.Error("index should be truncated", fi.Size())
+	}
+}
+
+func TestMigrateLegacy(t *testing.T) {
+	var dir = tempDir(t)
+	defer os.RemoveAll(dir)
+
+	var legacy = append(frame("first"), frame("second")...)
+	var legacyFile = filepath.Join(dir, "sign.data")
+	// a broken pack at tail
+	if err := ioutil.WriteFile(legacyFile, append(legacy, frame("third")[:6]...), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ImportLegacy(legacyFile, filepath.Join(dir, "copy"), 1024); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(legacyFile); err != nil {
+		t.Error("legacy file should be left after import", err)
+	}
+	if err := MigrateLegacy(legacyFile, filepath.Join(dir, "sign"), 1024); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(legacyFile); !os.IsNotExist(err) {
+		t.Error("legacy file should be removed", err)
+	}
+
+	store, err := Open(filepath.Join(dir, "sign"), 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	if store.Size() != int64(len(legacy)) || len(store.Entries()) != 2 {
+		t.Error("unexpected migrated history", store.Size(), store.Entries())
+	}
+	var buf = make([]byte, len(legacy))
+	if _, err := store.ReadAt(buf, 0); err != nil || !bytes.Equal(buf, legacy) {
+		t.Error("migrated history should be byte-compatible", err)
+	}
+}
+
+// dataFrame makes an uncompressed DATA pack.
+func dataFrame(body string) []byte {
+	return frame("\x04" + body)
+}
+
+func TestRepair(t *testing.T) {
+	var dir = tempDir(t)
+	defer os.RemoveAll(dir)
+
+	store, err := Open(dir, 16)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var whole []byte
+	for _, body := range []string{"first", "second pack", "third"} {
+		store.Write(dataFrame(body))
+		whole = append(whole, dataFrame(body)...)
+	}
+	if v := store.Validate(); v.Broken() || v.Packs != 3 {
+		t.Error("history should be fine", v)
+	}
+	store.Close()
+
+	// the process dies after a pack is written but not indexed, and in the
+	// middle of the next one
+	var last = len(whole)
+	whole = append(whole, dataFrame("unindexed")...)
+	var unindexed = len(whole)
+	whole = append(whole, dataFrame("partial")[:7]...)
+	for seq := 0; int64(seq)*16 < int64(len(whole)); seq++ {
+		var end = (seq + 1) * 16
+		if end > len(whole) {
+			end = len(whole)
+		}
+		ioutil.WriteFile(segmentName(dir, seq), whole[seq*16:end], 0644)
+	}
+
+	store, err = Open(dir, 16)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	v, err := store.Repair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !v.Broken() || v.ValidSize != int64(unindexed) || v.Unindexed != 1 || v.Packs != 4 {
+		t.Error("unexpected validation", v)
+	}
+	if store.Size() != int64(unindexed) {
+		t.Error("history should be truncated", store.Size())
+	}
+	var entries = store.Entries()
+	if len(entries) != 4 || entries[3].Offset != int64(last) || entries[3].Timestamp != entries[2].Timestamp {
+		t.Error("unindexed pack should be indexed", entries)
+	}
+	if v := store.Validate(); v.Broken() {
+		t.Error("history should be fine after repair", v)
+	}
+
+	// keeps working after repair
+	store.Write(dataFrame("after"))
+	if v := store.Validate(); v.Broken() || v.Packs != 5 {
+		t.Error("history should be fine after writing", v)
+	}
+}
+
+func TestTruncate(t *testing.T) {
+	var dir = tempDir(t)
+	defer os.RemoveAll(dir)
+
+	store, err := Open(dir, 8)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	var offsets []int64
+	for _, body := range []string{"first", "second", "third"} {
+		offset, _ := store.Write(dataFrame(body))
+		offsets = append(offsets, offset)
+	}
+	if err := store.Truncate(offsets[1]); err != nil {
+		t.Fatal(err)
+	}
+	if store.Size() != offsets[1] || len(store.Entries()) != 1 {
+		t.Error("unexpected truncated history", store.Size(), store.Entries())
+	}
+	if _, err := os.Stat(segmentName(dir, 2)); !os.IsNotExist(err) {
+		t.Error("segments beyond size should be removed", err)
+	}
+	if v := store.Validate(); v.Broken() {
+		t.Error("history should be fine after truncate", v)
+	}
+}
+
+func TestRepairFile(t *testing.T) {
+	var dir = tempDir(t)
+	defer os.RemoveAll(dir)
+
+	var name = filepath.Join(dir, "sign.data")
+	var good = append(dataFrame("first"), dataFrame("second")...)
+	ioutil.WriteFile(name, append(good, dataFrame("third")[:8]...), 0644)
+	v, err := RepairFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !v.Broken() || v.ValidSize != int64(len(good)) || v.Packs != 2 {
+		t.Error("unexpected validation", v)
+	}
+	if fi, _ := os.Stat(name); fi.Size() != int64(len(good)) {
+		t.Error("file should be truncated", fi.Size())
+	}
+}
+
+func TestRepairKeepsAnyPackType(t *testing.T) {
+	var dir = tempDir(t)
+	defer os.RemoveAll(dir)
+
+	var name = filepath.Join(dir, "sign.data")
+	// a message pack, and one with header bits unknown to this version
+	var good = append(append(dataFrame("first"), frame("\x06message")...), frame("\xc4newer")...)
+	ioutil.WriteFile(name, append(good, 0, 0, 0, 0), 0644)
+	v, err := RepairFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v.ValidSize != int64(len(good)) || v.Packs != 3 {
+		t.Error("only framing errors should be truncated", v)
+	}
+}
+
+func TestSnapshot(t *testing.T) {
+	var dir = tempDir(t)
+	defer os.RemoveAll(dir)
+
+	store, err := Open(dir, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	if offset, data, err := store.LatestSnapshot(); offset != 0 || data != nil || err != nil {
+		t.Error("there should be no snapshot", offset, data, err)
+	}
+	store.Write(dataFrame("first"))
+	var first = store.End()
+	store.Write(dataFrame("second"))
+	var second = store.End()
+
+	store.SaveSnapshot(first, []byte("old"))
+	store.SaveSnapshot(second, []byte("new"))
+	if offset, data, _ := store.LatestSnapshot(); offset != second || string(data) != "new" {
+		t.Error("unexpected latest snapshot", offset, string(data))
+	}
+	if _, err := os.Stat(snapshotName(dir, first)); !os.IsNotExist(err) {
+		t.Error("old snapshot should be removed", err)
+	}
+	if err := store.SaveSnapshot(second+1, nil); err != ErrOutOfRange {
+		t.Error("snapshot beyond history should fail", err)
+	}
+
+	var frames []string
+	store.Frames(0, second, func(frame []byte) error {
+		frames = append(frames, string(frame[SIZE_HEADER_LEN+1:]))
+		return nil
+	})
+	if len(frames) != 2 || frames[1] != "second" {
+		t.Error("unexpected frames", frames)
+	}
+
+	store.Truncate(first)
+	if offset, data, _ := store.LatestSnapshot(); offset != 0 || data != nil {
+		t.Error("snapshot beyond history should be dropped", offset, data)
+	}
+}
+
+func TestCopyPacks(t *testing.T) {
+	var dir = tempDir(t)
+	defer os.RemoveAll(dir)
+
+	src, err := Open(filepath.Join(dir, "src"), 64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer src.Close()
+	var start = time.Unix(100, 0)
+	for i, body := range []string{"first", "second", "third"} {
+		src.WriteAt(dataFrame(body), start.Add(time.Duration(i)*time.Second))
+	}
+	var second = src.Entries()[1].Offset
+
+	dst, err := Open(filepath.Join(dir, "dst"), 64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dst.Close()
+	dst.Write(dataFrame("baseline"))
+	if err := src.CopyPacks(dst, second, src.Size()); err != nil {
+		t.Fatal(err)
+	}
+	var entries = dst.Entries()
+	if len(entries) != 3 || entries[1].Timestamp != start.Add(time.Second).UnixNano() {
+		t.Fatal("unexpected entries", entries)
+	}
+	var buf = make([]byte, entries[2].Length)
+	dst.ReadAt(buf, entries[2].Offset)
+	if !bytes.Equal(buf, dataFrame("third")) {
+		t.Error("unexpected pack", buf)
+	}
+}
@@ -0,0 +1,162 @@
+package History
+
+import (
+	"encoding/binary"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// Index file is a header followed by fixed-size entries, all big-endian:
+//
+//	header: magic "PTHI", version uint32, segment size int64
+//	entry:  offset int64, length int64, timestamp int64 (unix nano)
+const (
+	INDEX_FILE_NAME         = "index"
+	INDEX_MAGIC             = "PTHI"
+	INDEX_VERSION    uint32 = 1
+	INDEX_HEADER_LEN        = 16
+	INDEX_ENTRY_LEN         = 24
+)
+
+var ErrBadIndex = errors.New("unknown index format")
+
+// Entry is where and when a pack is recorded.
+type Entry struct {
+	Offset    int64
+	Length    int64
+	Timestamp int64
+}
+
+type Index struct {
+	file        *os.File
+	segmentSize int64
+	entries     []Entry
+}
+
+func openIndex(dir string, segmentSize int64, flag int) (*Index, error) {
+	var name = filepath.Join(dir, INDEX_FILE_NAME)
+	if flag != os.O_RDONLY {
+		flag |= os.O_CREATE
+	}
+	file, err := os.OpenFile(name, flag, 0644)
+	if err != nil {
+		return nil, err
+	}
+	var index = &Index{
+		file:        file,
+		segmentSize: segmentSize,
+		entries:     make([]Entry, 0),
+	}
+	raw, err := ioutil.ReadFile(name)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	if len(raw) == 0 {
+		if err := index.writeHeader(); err != nil {
+			file.Close()
+			return nil, err
+		}
+		return index, nil
+	}
+	if err := index.parse(raw, flag != os.O_RDONLY); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return index, nil
+}
+
+func (i *Index) writeHeader() error {
+	var header = make([]byte, INDEX_HEADER_LEN)
+	copy(header, INDEX_MAGIC)
+	binary.BigEndian.PutUint32(header[4:], INDEX_VERSION)
+	binary.BigEndian.PutUint64(header[8:], uint64(i.segmentSize))
+	_, err := i.file.WriteAt(header, 0)
+	return err
+}
+
+// parse reads header and entries. If fix is set, a partly written entry at
+// tail is dropped.
+func (i *Index) parse(raw []byte, fix bool) error {
+	if len(raw) < INDEX_HEADER_LEN || string(raw[:4]) != INDEX_MAGIC {
+		return ErrBadIndex
+	}
+	if binary.BigEndian.Uint32(raw[4:]) != INDEX_VERSION {
+		return ErrBadIndex
+	}
+	i.segmentSize = int64(binary.BigEndian.Uint64(raw[8:]))
+	if i.segmentSize <= 0 {
+		return ErrBadIndex
+	}
+	for pos := INDEX_HEADER_LEN; pos+INDEX_ENTRY_LEN <= len(raw); pos += INDEX_ENTRY_LEN {
+		i.entries = append(i.entries, Entry{
+			Offset:    int64(binary.BigEndian.Uint64(raw[pos:])),
+			Length:    int64(binary.BigEndian.Uint64(raw[pos+8:])),
+			Timestamp: int64(binary.BigEndian.Uint64(raw[pos+16:])),
+		})
+	}
+	if !fix {
+		return nil
+	}
+	return i.truncate(len(i.entries))
+}
+
+func (i *Index) append(entry Entry) error {
+	var raw = make([]byte, INDEX_ENTRY_LEN)
+	binary.BigEndian.PutUint64(raw, uint64(entry.Offset))
+	binary.BigEndian.PutUint64(raw[8:], uint64(entry.Length))
+	binary.BigEndian.PutUint64(raw[16:], uint64(entry.Timestamp))
+	var pos = int64(INDEX_HEADER_LEN + len(i.entries)*INDEX_ENTRY_LEN)
+	if _, err := i.file.WriteAt(raw, pos); err != nil {
+		return err
+	}
+	i.entries = append(i.entries, entry)
+	return nil
+}
+
+// truncate keeps the first n entries.
+func (i *Index) truncate(n int) error {
+	i.entries = i.entries[:n]
+	return i.file.Truncate(int64(INDEX_HEADER_LEN + n*INDEX_ENTRY_LEN))
+}
+
+// rewrite replaces all entries.
+func (i *Index) rewrite(entries []Entry) error {
+	if err := i.truncate(0); err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if err := i.append(entry); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// dropAfter drops entries beyond size of history.
+func (i *Index) dropAfter(size int64) error {
+	var n = len(i.entries)
+	for n > 0 && i.entries[n-1].Offset+i.entries[n-1].Length > size {
+		n--
+	}
+	if n == len(i.entries) {
+		return nil
+	}
+	return i.truncate(n)
+}
+
+func (i *Index) copyEntries() []Entry {
+	var entries = make([]Entry, len(i.entries))
+	copy(entries, i.entries)
+	return entries
+}
+
+func (i *Index) sync() error {
+	return i.file.Sync()
+}
+
+func (i *Index) close() error {
+	return i.file.Close()
+}
@@ -0,0 +1,97 @@
+package History
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"log"
+	"os"
+)
+
+const (
+	SIZE_HEADER_LEN  = 4
+	MIGRATING_SUFFIX = ".migrating" // store being imported, not usable yet
+)
+
+// readFrame reads a pack as recorded, size header included.
+func readFrame(r io.Reader) ([]byte, error) {
+	var sizeHeader [SIZE_HEADER_LEN]byte
+	if _, err := io.ReadFull(r, sizeHeader[:]); err != nil {
+		return nil, err
+	}
+	var size = binary.BigEndian.Uint32(sizeHeader[:])
+	var frame = make([]byte, SIZE_HEADER_LEN+int(size))
+	copy(frame, sizeHeader[:])
+	if _, err := io.ReadFull(r, frame[SIZE_HEADER_LEN:]); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	return frame, nil
+}
+
+// MigrateLegacy moves history in a single .data file, which is how rooms
+// were recorded before, into a new store in dir. Nothing happens if there's
+// no such file, or dir exists already.
+func MigrateLegacy(legacyFile, dir string, segmentSize int64) error {
+	_, err := os.Stat(legacyFile)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if _, err := os.Stat(dir); err == nil {
+		return nil
+	}
+	if err := ImportLegacy(legacyFile, dir, segmentSize); err != nil {
+		return err
+	}
+	log.Println("legacy history", legacyFile, "is migrated to", dir)
+	return os.Remove(legacyFile)
+}
+
+// ImportLegacy copies history in a legacy .data file into a new store in
+// dir, and leaves the file as is. Timestamps of packs are unknown, so
+// modification time of the file is used.
+func ImportLegacy(legacyFile, dir string, segmentSize int64) error {
+	fi, err := os.Stat(legacyFile)
+	if err != nil {
+		return err
+	}
+	file, err := os.Open(legacyFile)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	var tmpDir = dir + MIGRATING_SUFFIX
+	os.RemoveAll(tmpDir)
+	store, err := Open(tmpDir, segmentSize)
+	if err != nil {
+		return err
+	}
+	store.SetSyncWrites(false)
+	var reader = bufio.NewReader(file)
+	for {
+		frame, err := readFrame(reader)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			log.Println("legacy history", legacyFile, "is broken at", store.Size(), err)
+			break
+		}
+		if _, err := store.WriteAt(frame, fi.ModTime()); err != nil {
+			store.Remove()
+			return err
+		}
+	}
+	if err := store.Sync(); err != nil {
+		store.Remove()
+		return err
+	}
+	store.Close()
+	return os.Rename(tmpDir, dir)
+}
@@ -0,0 +1,48 @@
+package History
+
+import (
+	"bufio"
+	"io"
+	"sort"
+	"time"
+)
+
+// Packs calls fn with each indexed pack from start to end in order, along
+// with where and when it's recorded.
+func (s *Store) Packs(start, end int64, fn func(entry Entry, frame []byte) error) error {
+	if end > s.Size() {
+		return ErrOutOfRange
+	}
+	var entries = s.Entries()
+	var first = sort.Search(len(entries), func(i int) bool {
+		return entries[i].Offset >= start
+	})
+	var reader = bufio.NewReaderSize(io.NewSectionReader(s, start, end-start), 64*1024)
+	var pos = start
+	for _, entry := range entries[first:] {
+		if entry.Offset+entry.Length > end {
+			break
+		}
+		if _, err := reader.Discard(int(entry.Offset - pos)); err != nil {
+			return err
+		}
+		var frame = make([]byte, entry.Length)
+		if _, err := io.ReadFull(reader, frame); err != nil {
+			return err
+		}
+		pos = entry.Offset + entry.Length
+		if err := fn(entry, frame); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// CopyPacks appends packs of s from start to end to dst, and keeps when they
+// were recorded.
+func (s *Store) CopyPacks(dst *Store, start, end int64) error {
+	return s.Packs(start, end, func(entry Entry, frame []byte) error {
+		_, err := dst.WriteAt(frame, time.Unix(0, entry.Timestamp))
+		return err
+	})
+}
@@ -0,0 +1,142 @@
+package History
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// A snapshot is packs that rebuild the canvas as it is at some offset of
+// history. Only the latest one is kept.
+const SNAPSHOT_PREFIX = "snapshot-"
+
+func snapshotName(dir string, offset int64) string {
+	return filepath.Join(dir, fmt.Sprintf("%s%016d", SNAPSHOT_PREFIX, offset))
+}
+
+// snapshotOffsets lists offsets of snapshots in dir.
+func snapshotOffsets(dir string) []int64 {
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil
+	}
+	var offsets = make([]int64, 0)
+	for _, info := range infos {
+		if !strings.HasPrefix(info.Name(), SNAPSHOT_PREFIX) {
+			continue
+		}
+		offset, err := strconv.ParseInt(strings.TrimPrefix(info.Name(), SNAPSHOT_PREFIX), 10, 64)
+		if err == nil {
+			offsets = append(offsets, offset)
+		}
+	}
+	return offsets
+}
+
+// End is where the last indexed pack ends, which is always a pack boundary.
+func (s *Store) End() int64 {
+	s.locker.RLock()
+	defer s.locker.RUnlock()
+	var entries = s.index.entries
+	if len(entries) == 0 {
+		return 0
+	}
+	return entries[len(entries)-1].Offset + entries[len(entries)-1].Length
+}
+
+// SaveSnapshot keeps data as snapshot at offset, and drops older ones.
+func (s *Store) SaveSnapshot(offset int64, data []byte) error {
+	s.locker.Lock()
+	defer s.locker.Unlock()
+	if offset > s.size {
+		return ErrOutOfRange
+	}
+	var name = snapshotName(s.dir, offset)
+	if err := ioutil.WriteFile(name+".tmp", data, 0644); err != nil {
+		return err
+	}
+	if err := os.Rename(name+".tmp", name); err != nil {
+		return err
+	}
+	for _, old := range snapshotOffsets(s.dir) {
+		if old != offset {
+			os.Remove(snapshotName(s.dir, old))
+		}
+	}
+	return nil
+}
+
+// SnapshotOffset is offset of the latest snapshot, 0 if there's none.
+func (s *Store) SnapshotOffset() int64 {
+	s.locker.RLock()
+	defer s.locker.RUnlock()
+	var latest int64
+	for _, offset := range snapshotOffsets(s.dir) {
+		if offset > latest && offset <= s.size {
+			latest = offset
+		}
+	}
+	return latest
+}
+
+// LatestSnapshot returns the latest snapshot and its offset. data is nil if
+// there's no snapshot.
+func (s *Store) LatestSnapshot() (int64, []byte, error) {
+	s.locker.RLock()
+	defer s.locker.RUnlock()
+	var latest int64 = -1
+	for _, offset := range snapshotOffsets(s.dir) {
+		if offset > latest && offset <= s.size {
+			latest = offset
+		}
+	}
+	if latest < 0 {
+		return 0, nil, nil
+	}
+	data, err := ioutil.ReadFile(snapshotName(s.dir, latest))
+	if err != nil {
+		return 0, nil, err
+	}
+	return latest, data, nil
+}
+
+// dropSnapshotsAfter removes snapshots beyond size of history.
+func (s *Store) dropSnapshotsAfter(size int64) {
+	for _, offset := range snapshotOffsets(s.dir) {
+		if offset > size {
+			os.Remove(snapshotName(s.dir, offset))
+		}
+	}
+}
+
+// Frames calls fn with each pack from start to end in order. start and end
+// should be pack boundaries.
+func (s *Store) Frames(start, end int64, fn func(frame []byte) error) error {
+	if end > s.Size() {
+		return ErrOutOfRange
+	}
+	var reader = bufio.NewReaderSize(io.NewSectionReader(s, start, end-start), 64*1024)
+	return ReadFrames(reader, fn)
+}
+
+// ReadFrames calls fn with each pack in r, which is packs concatenated like
+// a snapshot.
+func ReadFrames(r io.Reader, fn func(frame []byte) error) error {
+	for {
+		frame, err := readFrame(r)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if err := fn(frame); err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,159 @@
+package History
+
+import (
+	"encoding/binary"
+	"io"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+// Validation tells how much of a history is made of complete packs.
+type Validation struct {
+	Size      int64 // bytes in history
+	ValidSize int64 // where the last complete pack ends
+	Packs     int   // complete packs
+	Unindexed int   // complete packs missing in index, or indexed wrongly
+}
+
+func (v Validation) Broken() bool {
+	return v.ValidSize != v.Size || v.Unindexed > 0
+}
+
+// scan walks history by size headers. It stops only at framing errors: a
+// pack without even a pack header, or one running past the end. Packs of
+// any type are accepted, since recorded ones may come from newer versions.
+func scan(r io.ReaderAt, size int64) ([]Entry, Validation) {
+	var frames = make([]Entry, 0)
+	var head = make([]byte, SIZE_HEADER_LEN)
+	var pos int64
+	for pos+int64(len(head)) <= size {
+		if _, err := r.ReadAt(head, pos); err != nil {
+			break
+		}
+		var bodyLength = int64(binary.BigEndian.Uint32(head))
+		if bodyLength == 0 {
+			break
+		}
+		var length = SIZE_HEADER_LEN + bodyLength
+		if pos+length > size {
+			break
+		}
+		frames = append(frames, Entry{
+			Offset: pos,
+			Length: length,
+		})
+		pos += length
+	}
+	return frames, Validation{
+		Size:      size,
+		ValidSize: pos,
+		Packs:     len(frames),
+	}
+}
+
+// Validate scans the whole history, and compares it with index.
+func (s *Store) Validate() Validation {
+	var entries = s.Entries()
+	frames, v := scan(s, s.Size())
+	for i, frame := range frames {
+		if i >= len(entries) || entries[i].Offset != frame.Offset || entries[i].Length != frame.Length {
+			v.Unindexed++
+		}
+	}
+	if len(entries) > len(frames) {
+		v.Unindexed += len(entries) - len(frames)
+	}
+	return v
+}
+
+// Repair truncates history back to the last complete pack, and rebuilds
+// index for packs recorded but not indexed. Those packs are considered
+// written at the time of last indexed one.
+func (s *Store) Repair() (Validation, error) {
+	var v = s.Validate()
+	if !v.Broken() {
+		return v, nil
+	}
+	var entries = s.Entries()
+	frames, _ := scan(s, v.ValidSize)
+	var timestamps = make(map[int64]int64)
+	for _, entry := range entries {
+		timestamps[entry.Offset] = entry.Timestamp
+	}
+	var last = time.Now().UnixNano()
+	if len(entries) > 0 {
+		last = entries[len(entries)-1].Timestamp
+	}
+	for i := range frames {
+		if timestamp, ok := timestamps[frames[i].Offset]; ok {
+			frames[i].Timestamp = timestamp
+		} else {
+			frames[i].Timestamp = last
+		}
+	}
+
+	s.locker.Lock()
+	defer s.locker.Unlock()
+	if err := s.truncate(v.ValidSize); err != nil {
+		return v, err
+	}
+	return v, s.index.rewrite(frames)
+}
+
+// Truncate drops everything after size.
+func (s *Store) Truncate(size int64) error {
+	s.locker.Lock()
+	defer s.locker.Unlock()
+	if err := s.truncate(size); err != nil {
+		return err
+	}
+	return s.index.dropAfter(size)
+}
+
+func (s *Store) truncate(size int64) error {
+	if size >= s.size {
+		return nil
+	}
+	var keep = int((size + s.segmentSize - 1) / s.segmentSize)
+	for seq := len(s.segments) - 1; seq >= keep; seq-- {
+		s.segments[seq].Close()
+		if err := os.Remove(segmentName(s.dir, seq)); err != nil {
+			return err
+		}
+	}
+	s.segments = s.segments[:keep]
+	if keep > 0 {
+		if err := s.segments[keep-1].Truncate(size - int64(keep-1)*s.segmentSize); err != nil {
+			return err
+		}
+	}
+	atomic.StoreInt64(&s.size, size)
+	s.dropSnapshotsAfter(size)
+	return nil
+}
+
+// ValidateFile scans a history file in legacy format.
+func ValidateFile(name string) (Validation, error) {
+	file, err := os.Open(name)
+	if err != nil {
+		return Validation{}, err
+	}
+	defer file.Close()
+	fi, err := file.Stat()
+	if err != nil {
+		return Validation{}, err
+	}
+	_, v := scan(file, fi.Size())
+	return v, nil
+}
+
+// RepairFile truncates a history file in legacy format back to the last
+// complete pack.
+func RepairFile(name string) (Validation, error) {
+	v, err := ValidateFile(name)
+	if err != nil || !v.Broken() {
+		return v, err
+	}
+	return v, os.Truncate(name, v.ValidSize)
+}
@@ -1,13 +1,20 @@
 package Radio
 
-import "time"
 import "server/pkg/Socket"
-import "server/pkg/BufferedFile"
+import "server/pkg/Canvas"
+import "server/pkg/History"
+import "path/filepath"
 import "sync"
+import "sync/atomic"
+import "log"
+import "time"
 
 type RadioTaskList struct {
-	tasks  []RadioChunk
-	locker sync.Mutex
+	tasks         []RadioChunk
+	locker        sync.Mutex
+	size          int64
+	history       int64 // archive bytes at front
+	historyChunks int
 }
 
 type RadioChunk interface {
@@ -33,76 +40,246 @@ func (c FileChunk) special() {
 	//
 }
 
+// RadioClient owns a writer goroutine, which wakes up by notify whenever
+// chunks are queued in list, and drains list as fast as socket allows.
 type RadioClient struct {
-	client    *Socket.SocketClient
-	sendChan  chan RAMChunk
-	writeChan chan FileChunk
-	list      *RadioTaskList
+	client *Socket.SocketClient
+	notify chan bool
+	done   chan bool
+	list   *RadioTaskList
+}
+
+// QueueLimits bounds how far a client can fall behind live. 0 means no limit.
+type QueueLimits struct {
+	MaxBytes  int64
+	MaxChunks int
+	Policy    string
+}
+
+// QueueStats counts how often clients fall too far behind.
+type QueueStats struct {
+	Dropped      int64 `json:"dropped"`
+	Disconnected int64 `json:"disconnected"`
+}
+
+// queue returns false if client falls too far behind and should go.
+// droppable chunks are thrown away instead under SLOW_CLIENT_DROP.
+func (c *RadioClient) queue(chunk RadioChunk, droppable bool, limits QueueLimits, stats *QueueStats) bool {
+	bytes, chunks := c.list.Backlog()
+	var tooManyBytes = limits.MaxBytes > 0 && bytes+chunkSize(chunk) > limits.MaxBytes
+	var tooManyChunks = limits.MaxChunks > 0 && chunks+1 > limits.MaxChunks
+	if tooManyBytes || tooManyChunks {
+		if droppable && limits.Policy == SLOW_CLIENT_DROP {
+			atomic.AddInt64(&stats.Dropped, 1)
+			return true
+		}
+		return false
+	}
+	appendToPendings(chunk, c.list)
+	select {
+	case c.notify <- true:
+	default:
+		// writer is already notified
+	}
+	return true
 }
 
 type RadioSendPart struct {
-	Data []byte
+	Data   []byte
+	UserId string // who draws it, for undo
 }
 
 type RadioSingleSendPart struct {
-	Data   []byte
-	Client *Socket.SocketClient
+	Data      []byte
+	Client    *Socket.SocketClient
+	Droppable bool // like text messages, dropped first for slow client
 }
 
 type Radio struct {
 	clients        map[*Socket.SocketClient]*RadioClient
-	file           *BufferedFile.BufferedFile
+	dataDir        string
+	store          atomic.Value // *History.Store, replaced on Prune
 	GoingClose     chan bool
 	SingleSendChan chan RadioSingleSendPart
 	SendChan       chan RadioSendPart
 	WriteChan      chan RadioSendPart
 	signature      string
+	limits         QueueLimits
+	stats          QueueStats
+	onSlowClient   func(client *Socket.SocketClient)
+	snapshotAt     int64 // offset of the latest snapshot
+	snapshotting   int32
+	compactedSize  int64 // size of history right after the last compaction
+	rebuilding     int32
+	closed         bool // history is never replaced once closed
+	undos          []undoRequest
+	undoing        bool // undos are being served
+	strokes        strokes
 	locker         sync.Mutex
 }
 
+func (r *Radio) SetQueueLimits(limits QueueLimits) {
+	r.locker.Lock()
+	defer r.locker.Unlock()
+	r.limits = limits
+}
+
+func (r *Radio) QueueStats() QueueStats {
+	return QueueStats{
+		Dropped:      atomic.LoadInt64(&r.stats.Dropped),
+		Disconnected: atomic.LoadInt64(&r.stats.Disconnected),
+	}
+}
+
+// OnSlowClient is called in a new goroutine once a client is removed for
+// falling too far behind.
+func (r *Radio) OnSlowClient(handler func(client *Socket.SocketClient)) {
+	r.locker.Lock()
+	defer r.locker.Unlock()
+	r.onSlowClient = handler
+}
+
+// Close stops radio. Channels are left open, so that anyone sending late
+// never panics, but nobody receives from them any more.
 func (r *Radio) Close() {
+	r.locker.Lock()
+	r.closed = true
+	r.locker.Unlock()
 	close(r.GoingClose)
-	close(r.SingleSendChan)
-	close(r.SendChan)
-	close(r.WriteChan)
 }
 
 func (r *Radio) Remove() {
 	r.locker.Lock()
 	defer r.locker.Unlock()
-	r.file.Close()
-	defer r.file.Remove()
+	r.closed = true
+	r.currentStore().Remove()
+}
+
+// Repair truncates history back to the last complete pack, in case process
+// died in the middle of writing.
+func (r *Radio) Repair() (History.Validation, error) {
+	r.locker.Lock()
+	defer r.locker.Unlock()
+	return r.currentStore().Repair()
+}
+
+// LatestSnapshot returns the latest snapshot of history and its offset, or
+// nil if there's none.
+func (r *Radio) LatestSnapshot() (int64, []byte, error) {
+	return r.currentStore().LatestSnapshot()
+}
+
+// TakeSnapshot renders history since the latest snapshot, and keeps result
+// as a new snapshot. It takes a while, so call it in a new goroutine.
+func (r *Radio) TakeSnapshot(width, height int) (int64, error) {
+	var store = r.currentStore()
+	canvas, offset, err := Canvas.Render(store, width, height)
+	if err != nil {
+		return 0, err
+	}
+	snapshot, err := canvas.Snapshot()
+	if err != nil {
+		return 0, err
+	}
+	// history may be replaced or removed meanwhile, which is done with
+	// r.locker held
+	r.locker.Lock()
+	defer r.locker.Unlock()
+	if store != r.currentStore() {
+		return 0, errHistoryReplaced
+	}
+	if err := store.SaveSnapshot(offset, snapshot); err != nil {
+		return 0, err
+	}
+	atomic.StoreInt64(&r.snapshotAt, offset)
+	return offset, nil
+}
+
+// Render rebuilds canvas at the end of history.
+func (r *Radio) Render(width, height int) (*Canvas.Canvas, error) {
+	canvas, _, err := Canvas.Render(r.currentStore(), width, height)
+	return canvas, err
+}
+
+// SnapshotIfNeeded takes a snapshot in background, once history grows
+// interval bytes since the latest one.
+func (r *Radio) SnapshotIfNeeded(width, height int, interval int64) {
+	if interval <= 0 || width <= 0 || height <= 0 {
+		return
+	}
+	if r.FileSize()-atomic.LoadInt64(&r.snapshotAt) < interval {
+		return
+	}
+	if !atomic.CompareAndSwapInt32(&r.snapshotting, 0, 1) {
+		return
+	}
+	go func() {
+		defer atomic.StoreInt32(&r.snapshotting, 0)
+		if _, err := r.TakeSnapshot(width, height); err != nil {
+			log.Println("cannot take snapshot of", r.currentStore().Dir(), err)
+		}
+	}()
+}
+
+func (r *Radio) currentStore() *History.Store {
+	return r.store.Load().(*History.Store)
 }
 
 func (r *Radio) Signature() string {
+	r.locker.Lock()
+	defer r.locker.Unlock()
 	return r.signature
 }
 
+// Prune starts a new empty history under a new signature.
 func (r *Radio) Prune() string {
 	r.locker.Lock()
 	defer r.locker.Unlock()
-	for _, v := range r.clients {
-		v.list = &RadioTaskList{
-			make([]RadioChunk, 0, 100),
-			sync.Mutex{},
-		}
+	if r.closed {
+		return r.signature
 	}
-	if err := r.file.Clear(); err != nil {
+	var signature = genArchiveSign(r.signature)
+	store, err := History.Open(filepath.Join(r.dataDir, signature), History.DEFAULT_SEGMENT_SIZE)
+	if err != nil {
 		panic(err)
 	}
-	r.signature = genArchiveSign(r.signature)
+	r.swap(store, signature)
 	return r.signature
 }
 
-func (r *Radio) AddClient(client *Socket.SocketClient, start, length int64) {
+// swap replaces history with store under signature, and removes the old
+// one. Clients have to download again. r.locker must be held.
+func (r *Radio) swap(store *History.Store, signature string) {
+	for _, v := range r.clients {
+		v.list.Clear()
+	}
+	r.strokes = make(strokes)
+	r.replace(store, signature)
+}
+
+// replace makes store the history under signature, and removes the old one.
+// r.locker must be held.
+func (r *Radio) replace(store *History.Store, signature string) {
+	var old = r.currentStore()
+	r.store.Store(store)
+	atomic.StoreInt64(&r.snapshotAt, 0)
+	old.Remove()
+	r.signature = signature
+}
+
+// AddClient sends history from start to client, and keeps client updated.
+// heads, like a snapshot, are sent before history.
+func (r *Radio) AddClient(client *Socket.SocketClient, start, length int64, heads ...[]byte) {
 	r.locker.Lock()
 	defer r.locker.Unlock()
+	// client downloads again
+	r.removeClient(client)
 
-	var list = &RadioTaskList{
-		make([]RadioChunk, 0),
-		sync.Mutex{},
+	var list = &RadioTaskList{tasks: make([]RadioChunk, 0)}
+	for _, head := range heads {
+		list.Append([]RadioChunk{RAMChunk{head}})
 	}
-	var fileSize = r.file.WholeSize()
+	var fileSize = r.currentStore().Size()
 	var startPos, chunkSize int64
 	if start > fileSize {
 		startPos = fileSize
@@ -121,72 +298,109 @@ func (r *Radio) AddClient(client *Socket.SocketClient, start, length int64) {
 		})
 		list.Append(chunks)
 	}
-	var radioClient = RadioClient{
-		client:    client,
-		sendChan:  make(chan RAMChunk),
-		writeChan: make(chan FileChunk),
-		list:      list,
+	list.history = list.Size()
+	list.historyChunks = list.Length()
+	var radioClient = &RadioClient{
+		client: client,
+		notify: make(chan bool, 1),
+		done:   make(chan bool),
+		list:   list,
 	}
-	//debugOut("init tasks", radioClient.list)
+	// history is already there
+	radioClient.notify <- true
 
-	r.clients[client] = &radioClient
+	r.clients[client] = radioClient
 
-	go r.processClient(client, &radioClient)
+	go r.processClient(client, radioClient)
 }
 
 func (r *Radio) processClient(client *Socket.SocketClient, radioClient *RadioClient) {
 	clientCloseChan := make(chan bool)
 	client.RegisterCloseCallback(func() {
-		clientCloseChan <- true
+		close(clientCloseChan)
 	})
+	var retry <-chan time.Time
+	var retries int
 	for {
 		select {
 		case _, _ = <-clientCloseChan:
 			r.RemoveClient(client)
-			close(clientCloseChan)
 			return
-		case chunk, ok := <-radioClient.sendChan:
-			if ok {
-				appendToPendings(chunk, radioClient.list)
-			} else {
-				r.RemoveClient(client)
-				return
-			}
-		case chunk, ok := <-radioClient.writeChan:
-			if ok {
-				appendToPendings(chunk, radioClient.list)
-			} else {
-				r.RemoveClient(client)
-				return
+		case _, _ = <-radioClient.done:
+			return
+		case _, _ = <-r.GoingClose:
+			return
+		case <-radioClient.notify:
+		case <-retry:
+		}
+		retry = nil
+		for {
+			more, err := fetchAndSend(client, radioClient.list, r.currentStore)
+			if err == errUnreadable && retries < READ_RETRY_TIMES {
+				// nothing may be written for a long time in an idle room
+				retry = time.After(READ_RETRY_INTERVAL << uint(retries))
+				retries++
+				break
 			}
-		case <-time.After(time.Millisecond * 100):
-			err := fetchAndSend(client, radioClient.list, r.file)
 			if err != nil {
+				log.Println("cannot send history to client:", err)
 				r.RemoveClient(client)
+				client.Close()
 				return
 			}
+			retries = 0
+			if !more {
+				break
+			}
 		}
 	}
 }
 
+// HasClient tells if client has asked for history, and is kept updated.
+func (r *Radio) HasClient(client *Socket.SocketClient) bool {
+	r.locker.Lock()
+	defer r.locker.Unlock()
+	_, ok := r.clients[client]
+	return ok
+}
+
 func (r *Radio) RemoveClient(client *Socket.SocketClient) {
 	r.locker.Lock()
 	defer r.locker.Unlock()
-	delete(r.clients, client)
+	r.removeClient(client)
+}
+
+func (r *Radio) removeClient(client *Socket.SocketClient) {
+	if cli, ok := r.clients[client]; ok {
+		close(cli.done)
+		delete(r.clients, client)
+	}
+}
+
+func (r *Radio) removeSlowClient(client *Socket.SocketClient) {
+	r.removeClient(client)
+	atomic.AddInt64(&r.stats.Disconnected, 1)
+	log.Println("client falls too far behind, disconnecting")
+	if r.onSlowClient != nil {
+		go r.onSlowClient(client)
+	}
 }
 
 func (r *Radio) RemoveAllClients() {
 	r.locker.Lock()
 	defer r.locker.Unlock()
+	for _, cli := range r.clients {
+		close(cli.done)
+	}
 	r.clients = make(map[*Socket.SocketClient]*RadioClient)
 }
 
 func (r *Radio) FileSize() int64 {
-	return r.file.WholeSize()
+	return r.currentStore().Size()
 }
 
 // SingleSend expected Buffer that send to one specific Client but doesn't record.
-func (r *Radio) singleSend(data []byte, client *Socket.SocketClient) {
+func (r *Radio) singleSend(data []byte, client *Socket.SocketClient, droppable bool) {
 	r.locker.Lock()
 	defer r.locker.Unlock()
 
@@ -194,25 +408,22 @@ func (r *Radio) singleSend(data []byte, client *Socket.SocketClient) {
 	if !ok {
 		return
 	}
-	//go func() {
-	select {
-	case cli.sendChan <- RAMChunk{data}:
-	case <-time.After(time.Second * 10):
-		r.RemoveClient(client)
+	if !cli.queue(RAMChunk{data}, droppable, r.limits, &r.stats) {
+		r.removeSlowClient(client)
 	}
-	//}()
 }
 
-func send_helper(
-	client *Socket.SocketClient,
-	cli *RadioClient,
-	data []byte,
-	r *Radio) {
-	defer func() { recover() }()
-	select {
-	case cli.sendChan <- RAMChunk{data}:
-	case <-time.After(time.Second * 10):
-		r.RemoveClient(client)
+// SendAtEnd queues what build returns to every client, after everything
+// queued before. offset is size of history, which every client has got by
+// the time it receives the data.
+func (r *Radio) SendAtEnd(build func(client *Socket.SocketClient, offset int64) []byte) {
+	r.locker.Lock()
+	defer r.locker.Unlock()
+	var offset = r.currentStore().Size()
+	for client, cli := range r.clients {
+		if !cli.queue(RAMChunk{build(client, offset)}, false, r.limits, &r.stats) {
+			r.removeSlowClient(client)
+		}
 	}
 }
 
@@ -221,39 +432,32 @@ func (r *Radio) send(data []byte) {
 	r.locker.Lock()
 	defer r.locker.Unlock()
 	for client, cli := range r.clients {
-		go send_helper(client, cli, data, r)
-	}
-}
-
-func write_helper(
-	client *Socket.SocketClient,
-	cli *RadioClient,
-	data []byte,
-	r *Radio,
-	oldPos int64) {
-	defer func() { recover() }() // in case cli.writeChan is closed
-	select {
-	case cli.writeChan <- FileChunk{
-		Start:  oldPos,
-		Length: int64(len(data)),
-	}:
-	case <-time.After(time.Second * 10):
-		r.RemoveClient(client)
+		if !cli.queue(RAMChunk{data}, true, r.limits, &r.stats) {
+			r.removeSlowClient(client)
+		}
 	}
 }
 
 // Write expected Buffer that send to every Client and record data.
-func (r *Radio) write(data []byte) {
-	var oldPos = r.file.WholeSize()
-	_, err := r.file.Write(data)
+func (r *Radio) write(data []byte, userId string) {
+	r.locker.Lock()
+	defer r.locker.Unlock()
+	oldPos, err := r.currentStore().Write(data)
 	if err != nil {
 		panic(err)
 	}
+	if len(userId) > 0 {
+		r.strokes.add(userId, oldPos)
+	}
 
-	r.locker.Lock()
-	defer r.locker.Unlock()
+	var chunk = FileChunk{
+		Start:  oldPos,
+		Length: int64(len(data)),
+	}
 	for client, cli := range r.clients {
-		go write_helper(client, cli, data, r, oldPos)
+		if !cli.queue(chunk, false, r.limits, &r.stats) {
+			r.removeSlowClient(client)
+		}
 	}
 }
 
@@ -271,36 +475,46 @@ func (r *Radio) run() {
 			if !ok {
 				return
 			}
-			r.singleSend(part.Data, part.Client)
+			r.singleSend(part.Data, part.Client, part.Droppable)
 		case part, ok := <-r.WriteChan:
 			if !ok {
 				return
 			}
-			r.write(part.Data)
+			r.write(part.Data, part.UserId)
 		}
 	}
 }
 
-func MakeRadio(fileName, sign string) (*Radio, error) {
-	var file, err = BufferedFile.MakeBufferedFile(
-		&BufferedFile.BufferedFileOption{
-			fileName,
-			time.Second * 20,
-			1024 * 50,
-		})
+// MakeRadio opens history of signature in dataDir. Legacy <signature>.data
+// file there is migrated at first.
+func MakeRadio(dataDir, sign string) (*Radio, error) {
+	var dir = filepath.Join(dataDir, sign)
+	var legacyFile = filepath.Join(dataDir, sign+".data")
+	if err := History.MigrateLegacy(legacyFile, dir, History.DEFAULT_SEGMENT_SIZE); err != nil {
+		return &Radio{}, err
+	}
+	store, err := History.Open(dir, History.DEFAULT_SEGMENT_SIZE)
 	if err != nil {
 		return &Radio{}, err
 	}
 	var radio = &Radio{
 		clients:        make(map[*Socket.SocketClient]*RadioClient),
-		file:           file,
+		dataDir:        dataDir,
 		GoingClose:     make(chan bool),
 		SingleSendChan: make(chan RadioSingleSendPart),
 		SendChan:       make(chan RadioSendPart),
 		WriteChan:      make(chan RadioSendPart),
 		locker:         sync.Mutex{},
 		signature:      sign,
+		strokes:        make(strokes),
+		limits: QueueLimits{
+			MaxBytes:  DEFAULT_MAX_QUEUE_BYTES,
+			MaxChunks: DEFAULT_MAX_QUEUE_CHUNKS,
+			Policy:    SLOW_CLIENT_DROP,
+		},
 	}
+	radio.store.Store(store)
+	radio.snapshotAt = store.SnapshotOffset()
 	go radio.run()
 	return radio, nil
 }
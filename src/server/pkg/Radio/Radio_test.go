@@ -2,14 +2,21 @@ package Radio
 
 import "testing"
 
-import "sync"
 import "log"
+import "io"
+import "io/ioutil"
+import "net"
+import "os"
+import "server/pkg/Socket"
+import "server/pkg/Canvas"
+import "server/pkg/History"
+import "bytes"
+import "time"
+import "strconv"
+import "sync/atomic"
 
 func TestRadioTaskList(t *testing.T) {
-	var taskList = RadioTaskList{
-		make([]RadioChunk, 0, 100),
-		sync.Mutex{},
-	}
+	var taskList = RadioTaskList{tasks: make([]RadioChunk, 0, 100)}
 
 	if taskList.Length() != 0 {
 		t.Log("taskList size is incorrect")
@@ -69,11 +76,25 @@ func TestRadioTaskList(t *testing.T) {
 	}
 }
 
-func TestRadio(t *testing.T) {
-	var taskList = RadioTaskList{
-		make([]RadioChunk, 0, 100),
-		sync.Mutex{},
+func TestBacklog(t *testing.T) {
+	var taskList = RadioTaskList{tasks: make([]RadioChunk, 0, 100)}
+	taskList.Append([]RadioChunk{FileChunk{0, 100}})
+	taskList.history = taskList.Size()
+	taskList.historyChunks = taskList.Length()
+
+	// live chunk next to archive
+	appendToPendings(FileChunk{100, 20}, &taskList)
+	if size, chunks := taskList.Backlog(); size != 20 || chunks != 1 {
+		t.Error("backlog is incorrect", size, chunks)
+	}
+	taskList.PopFront()
+	if size, chunks := taskList.Backlog(); size != 20 || chunks != 1 {
+		t.Error("backlog is incorrect after archive is sent", size, chunks)
 	}
+}
+
+func TestRadio(t *testing.T) {
+	var taskList = RadioTaskList{tasks: make([]RadioChunk, 0, 100)}
 
 	var item = FileChunk{
 		0,
@@ -110,3 +131,458 @@ func TestRadio(t *testing.T) {
 	log.Println(taskList.Tasks())
 
 }
+
+func benchmarkRadio(b testing.TB) (*Radio, func()) {
+	dir, err := ioutil.TempDir("", "radio")
+	if err != nil {
+		b.Fatal(err)
+	}
+	radio, err := MakeRadio(dir, "bench")
+	if err != nil {
+		b.Fatal(err)
+	}
+	return radio, func() {
+		radio.Close()
+		radio.Remove()
+		os.RemoveAll(dir)
+	}
+}
+
+func TestSlowClient(t *testing.T) {
+	radio, cleanup := benchmarkRadio(t)
+	defer cleanup()
+	radio.SetQueueLimits(QueueLimits{
+		MaxBytes:  1024 * 1024,
+		MaxChunks: 2,
+		Policy:    SLOW_CLIENT_DROP,
+	})
+	var slowClients = make(chan *Socket.SocketClient, 1)
+	radio.OnSlowClient(func(client *Socket.SocketClient) {
+		slowClients <- client
+	})
+
+	// nobody reads the other side
+	serverConn, clientConn := net.Pipe()
+	defer clientConn.Close()
+	var client = Socket.MakeSocketClient(serverConn)
+	defer client.Close()
+	radio.AddClient(client, 0, 0)
+
+	for i := 0; i < 10; i++ {
+		radio.send([]byte("message"))
+	}
+	if radio.QueueStats().Dropped <= 0 {
+		t.Error("messages should be dropped for slow client", radio.QueueStats())
+	}
+	if radio.QueueStats().Disconnected != 0 {
+		t.Error("slow client should not be disconnected for messages", radio.QueueStats())
+	}
+
+	// writer may have taken one chunk out of queue already
+	radio.write([]byte("data"), "")
+	radio.write([]byte("data"), "")
+	if radio.QueueStats().Disconnected != 1 {
+		t.Error("slow client should be disconnected for data", radio.QueueStats())
+	}
+	select {
+	case cli := <-slowClients:
+		if cli != client {
+			t.Error("OnSlowClient called with wrong client")
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("OnSlowClient is not called")
+	}
+}
+
+func TestAddClientAgain(t *testing.T) {
+	radio, cleanup := benchmarkRadio(t)
+	defer cleanup()
+	serverConn, clientConn := net.Pipe()
+	defer clientConn.Close()
+	var client = Socket.MakeSocketClient(serverConn)
+	defer client.Close()
+
+	radio.AddClient(client, 0, 0)
+	var first = radio.clients[client]
+	radio.AddClient(client, 0, 0)
+	select {
+	case <-first.done:
+	default:
+		t.Error("writer of the first request should stop")
+	}
+	if len(radio.clients) != 1 {
+		t.Error("unexpected clients", len(radio.clients))
+	}
+}
+
+func TestCompact(t *testing.T) {
+	radio, cleanup := benchmarkRadio(t)
+	defer cleanup()
+	var stroke = Socket.AssamblePack(Socket.PackHeader{Compress: true, PackType: Socket.DATA},
+		[]byte(`{"action":"drawpoint","point":{"x":5,"y":5},
+		"brush":{"width":4,"color":{"red":9,"green":9,"blue":9}},"pressure":1,"layer":"layer0"}`))
+	for i := 0; i < 100; i++ {
+		radio.write(stroke, "")
+	}
+	var oldDir = radio.currentStore().Dir()
+	var before = radio.FileSize()
+	if !radio.ShouldCompact(before) {
+		t.Error("history should be compacted")
+	}
+
+	signature, err := radio.Compact(10, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if signature == "bench" || radio.Signature() != signature {
+		t.Error("compaction should issue a new signature", signature)
+	}
+	if _, err := os.Stat(oldDir); !os.IsNotExist(err) {
+		t.Error("old history should be removed", err)
+	}
+	if radio.FileSize() >= before {
+		t.Error("history should be smaller", radio.FileSize(), before)
+	}
+	if radio.ShouldCompact(before) {
+		t.Error("history should not be compacted again so soon")
+	}
+
+	radio.write(stroke, "")
+	canvas, _, err := Canvas.Render(radio.currentStore(), 10, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c := canvas.Layer("layer0").RGBAAt(5, 5); c.A != 255 || c.R != 9 {
+		t.Error("compacted history should render the same", c)
+	}
+}
+
+func TestRewrite(t *testing.T) {
+	radio, cleanup := benchmarkRadio(t)
+	defer cleanup()
+	var packs = [][]byte{[]byte("layer0 a"), []byte("layer1 b"), []byte("layer0 c")}
+	for _, pack := range packs {
+		radio.write(pack, "")
+	}
+	signature, err := radio.Rewrite(func(entry History.Entry, frame []byte) bool {
+		return !bytes.HasPrefix(frame, []byte("layer1"))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if signature != radio.Signature() || signature == "bench" {
+		t.Error("rewrite should issue a new signature", signature)
+	}
+	var buf = make([]byte, radio.FileSize())
+	radio.currentStore().ReadAt(buf, 0)
+	if string(buf) != "layer0 alayer0 c" {
+		t.Error("unexpected history", string(buf))
+	}
+}
+
+func TestMoveChunk(t *testing.T) {
+	dir, err := ioutil.TempDir("", "radio")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	old, err := History.Open(dir, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer old.Close()
+	for _, pack := range []string{"aaaaaaaaaa", "bbbbbbbbbb", "cccccccccc"} {
+		old.Write([]byte(pack))
+	}
+	// the second one is removed
+	var moves = []packMove{
+		{History.Entry{Offset: 0, Length: 10}, 0},
+		{History.Entry{Offset: 10, Length: 10}, -1},
+		{History.Entry{Offset: 20, Length: 10}, 10},
+	}
+
+	var moved = moveChunk(FileChunk{5, 25}, true, moves, old)
+	if len(moved) != 2 || moved[0] != (FileChunk{5, 5}) || moved[1] != (FileChunk{10, 10}) {
+		t.Error("unexpected chunks", moved)
+	}
+	moved = moveChunk(FileChunk{12, 13}, true, moves, old)
+	if len(moved) != 2 || string(moved[0].(RAMChunk).Data) != "bbbbbbbb" || moved[1] != (FileChunk{10, 5}) {
+		t.Error("rest of a pack should be sent if head is sent", moved)
+	}
+	moved = moveChunk(FileChunk{12, 13}, false, moves, old)
+	if len(moved) != 1 || moved[0] != (FileChunk{10, 5}) {
+		t.Error("unexpected chunks", moved)
+	}
+}
+
+func TestUndo(t *testing.T) {
+	radio, cleanup := benchmarkRadio(t)
+	defer cleanup()
+	radio.write([]byte("alice 1 "), "alice")
+	radio.write([]byte("bob 1 "), "bob")
+	radio.write([]byte("alice 2 "), "alice")
+	radio.write([]byte("bob 2 "), "bob")
+
+	offset, signature, err := radio.Undo("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if offset != 14 || signature != radio.Signature() {
+		t.Error("unexpected undo", offset, signature)
+	}
+	// bob's are moved
+	radio.Undo("alice")
+	if _, _, err := radio.Undo("alice"); err != ErrNothingToUndo {
+		t.Error("nothing should be left to undo", err)
+	}
+	if _, _, err := radio.Undo("bob"); err != nil {
+		t.Fatal(err)
+	}
+	var buf = make([]byte, radio.FileSize())
+	radio.currentStore().ReadAt(buf, 0)
+	if string(buf) != "bob 1 " {
+		t.Error("unexpected history", string(buf))
+	}
+}
+
+func TestUndoWaits(t *testing.T) {
+	radio, cleanup := benchmarkRadio(t)
+	defer cleanup()
+	radio.write([]byte("alice 1 "), "alice")
+
+	// as if another undo is rewriting history
+	atomic.StoreInt32(&radio.rebuilding, 1)
+	time.AfterFunc(100*time.Millisecond, func() {
+		atomic.StoreInt32(&radio.rebuilding, 0)
+	})
+	if _, _, err := radio.Undo("alice"); err != nil {
+		t.Error("undo should wait for others", err)
+	}
+}
+
+func TestUndoBatch(t *testing.T) {
+	radio, cleanup := benchmarkRadio(t)
+	defer cleanup()
+	radio.write([]byte("alice 1 "), "alice")
+	radio.write([]byte("bob 1 "), "bob")
+	radio.write([]byte("alice 2 "), "alice")
+	radio.write([]byte("carol 1 "), "carol")
+
+	// undos come while history is being rewritten
+	atomic.StoreInt32(&radio.rebuilding, 1)
+	type result struct {
+		offset    int64
+		signature string
+		err       error
+	}
+	var results = make(chan result, 4)
+	for _, userId := range []string{"alice", "alice", "bob", "dave"} {
+		go func(userId string) {
+			offset, signature, err := radio.Undo(userId)
+			results <- result{offset, signature, err}
+		}(userId)
+	}
+	for {
+		radio.locker.Lock()
+		var pending = len(radio.undos)
+		radio.locker.Unlock()
+		if pending == 4 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	atomic.StoreInt32(&radio.rebuilding, 0)
+
+	var offsets = make(map[int64]bool)
+	var failed int
+	for i := 0; i < 4; i++ {
+		var r = <-results
+		if r.err == ErrNothingToUndo {
+			failed++
+			continue
+		}
+		if r.err != nil || r.signature != radio.Signature() {
+			t.Error("undos should be done in one rewrite", r)
+		}
+		offsets[r.offset] = true
+	}
+	if failed != 1 || len(offsets) != 3 || !offsets[0] || !offsets[8] || !offsets[14] {
+		t.Error("unexpected strokes undone", offsets, failed)
+	}
+	var buf = make([]byte, radio.FileSize())
+	radio.currentStore().ReadAt(buf, 0)
+	if string(buf) != "carol 1 " {
+		t.Error("unexpected history", string(buf))
+	}
+}
+
+func TestPurge(t *testing.T) {
+	radio, cleanup := benchmarkRadio(t)
+	defer cleanup()
+	// recorded before restart
+	radio.write([]byte("mallory 0 "), "")
+	radio.write([]byte("alice 1 "), "alice")
+	radio.write([]byte("mallory 1 "), "mallory")
+	radio.write([]byte("spoofed "), "mallory")
+	radio.write([]byte("alice 2 "), "alice")
+
+	_, err := radio.Purge("mallory", func(entry History.Entry, frame []byte) bool {
+		return bytes.HasPrefix(frame, []byte("mallory"))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf = make([]byte, radio.FileSize())
+	radio.currentStore().ReadAt(buf, 0)
+	if string(buf) != "alice 1 alice 2 " {
+		t.Error("unexpected history", string(buf))
+	}
+	if offset, _, err := radio.Undo("alice"); err != nil || offset != 8 {
+		t.Error("strokes of others should be kept", offset, err)
+	}
+}
+
+func TestRollback(t *testing.T) {
+	radio, cleanup := benchmarkRadio(t)
+	defer cleanup()
+	var start = time.Unix(1000, 0)
+	for i, pack := range []string{"first ", "second ", "third "} {
+		radio.currentStore().WriteAt([]byte(pack), start.Add(time.Duration(i)*time.Minute))
+	}
+	radio.write([]byte("now "), "alice")
+
+	signature, err := radio.Rollback(start.Add(90 * time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if signature != radio.Signature() || signature == "bench" {
+		t.Error("rollback should issue a new signature", signature)
+	}
+	var buf = make([]byte, radio.FileSize())
+	radio.currentStore().ReadAt(buf, 0)
+	if string(buf) != "first second " {
+		t.Error("unexpected history", string(buf))
+	}
+	if _, _, err := radio.Undo("alice"); err != ErrNothingToUndo {
+		t.Error("dropped strokes should not be undone", err)
+	}
+}
+
+func TestRewriteAfterClose(t *testing.T) {
+	dir, err := ioutil.TempDir("", "radio")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	radio, err := MakeRadio(dir, "closed")
+	if err != nil {
+		t.Fatal(err)
+	}
+	radio.write([]byte("data"), "")
+
+	// room closes while copying
+	_, err = radio.Rewrite(func(entry History.Entry, frame []byte) bool {
+		radio.Close()
+		return true
+	})
+	if err != ErrClosed {
+		t.Error("rewrite should fail once closed", err)
+	}
+	if _, err := radio.Rewrite(func(History.Entry, []byte) bool { return true }); err != ErrClosed {
+		t.Error("rewrite should fail once closed", err)
+	}
+	if radio.Signature() != "closed" {
+		t.Error("signature should be kept", radio.Signature())
+	}
+	radio.Remove()
+	if names, _ := ioutil.ReadDir(dir); len(names) != 0 {
+		t.Error("new history should be removed", names[0].Name())
+	}
+}
+
+func TestSnapshotOfRemovedHistory(t *testing.T) {
+	radio, cleanup := benchmarkRadio(t)
+	defer cleanup()
+	radio.write([]byte("data"), "")
+	var dir = radio.currentStore().Dir()
+	radio.Remove()
+	if _, err := radio.TakeSnapshot(10, 10); err == nil {
+		t.Error("snapshot of removed history should fail")
+	}
+	if _, err := os.Stat(dir); !os.IsNotExist(err) {
+		t.Error("removed history should stay removed", err)
+	}
+}
+
+func TestSendAtEnd(t *testing.T) {
+	radio, cleanup := benchmarkRadio(t)
+	defer cleanup()
+	serverConn, clientConn := net.Pipe()
+	defer clientConn.Close()
+	var client = Socket.MakeSocketClient(serverConn)
+	defer client.Close()
+	radio.AddClient(client, 0, 0)
+
+	radio.write([]byte("data"), "")
+	radio.SendAtEnd(func(cli *Socket.SocketClient, offset int64) []byte {
+		if cli != client {
+			t.Error("sent to unknown client")
+		}
+		return []byte(strconv.FormatInt(offset, 10))
+	})
+	var buf = make([]byte, 5)
+	clientConn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.ReadFull(clientConn, buf); err != nil || string(buf) != "data4" {
+		t.Error("offset should be sent after data", string(buf), err)
+	}
+}
+
+func TestRetryUnreadableChunk(t *testing.T) {
+	radio, cleanup := benchmarkRadio(t)
+	defer cleanup()
+	serverConn, clientConn := net.Pipe()
+	defer clientConn.Close()
+	var client = Socket.MakeSocketClient(serverConn)
+	defer client.Close()
+	radio.AddClient(client, 0, 0)
+
+	// queued before it's in history, and nothing else is written then
+	radio.locker.Lock()
+	var cli = radio.clients[client]
+	radio.locker.Unlock()
+	appendToPendings(FileChunk{0, 4}, cli.list)
+	cli.notify <- true
+	time.Sleep(2 * READ_RETRY_INTERVAL)
+	radio.currentStore().Write([]byte("data"))
+
+	var buf = make([]byte, 4)
+	clientConn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.ReadFull(clientConn, buf); err != nil || string(buf) != "data" {
+		t.Error("chunk should be sent once it's readable", string(buf), err)
+	}
+}
+
+// BenchmarkArchive measures how fast a history is sent to a new client.
+func BenchmarkArchive(b *testing.B) {
+	radio, cleanup := benchmarkRadio(b)
+	defer cleanup()
+
+	var pack = make([]byte, 1024)
+	for i := 0; i < 4*1024; i++ {
+		radio.write(pack, "")
+	}
+	var size = radio.FileSize()
+	b.SetBytes(size)
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		serverConn, clientConn := net.Pipe()
+		var client = Socket.MakeSocketClient(serverConn)
+		radio.AddClient(client, 0, size)
+		if _, err := io.CopyN(ioutil.Discard, clientConn, size); err != nil {
+			b.Fatal(err)
+		}
+		client.Close()
+		clientConn.Close()
+	}
+}
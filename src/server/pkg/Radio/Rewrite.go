@@ -0,0 +1,337 @@
+package Radio
+
+import (
+	"bytes"
+	"path/filepath"
+	"server/pkg/Canvas"
+	"server/pkg/History"
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+// Compact replaces history with layer images rendered from it, followed by
+// packs recorded while rendering, under a new signature. It takes a while,
+// so call it in a new goroutine.
+func (r *Radio) Compact(width, height int) (string, error) {
+	if !atomic.CompareAndSwapInt32(&r.rebuilding, 0, 1) {
+		return "", ErrRebuilding
+	}
+	defer atomic.StoreInt32(&r.rebuilding, 0)
+
+	var old = r.currentStore()
+	canvas, end, err := Canvas.Render(old, width, height)
+	if err != nil {
+		return "", err
+	}
+	baseline, err := canvas.Snapshot()
+	if err != nil {
+		return "", err
+	}
+
+	r.locker.Lock()
+	defer r.locker.Unlock()
+	if r.closed {
+		return "", ErrClosed
+	}
+	if old != r.currentStore() {
+		// pruned meanwhile
+		return "", ErrRebuilding
+	}
+	var signature = genArchiveSign(r.signature)
+	store, err := History.Open(filepath.Join(r.dataDir, signature), History.DEFAULT_SEGMENT_SIZE)
+	if err != nil {
+		return "", err
+	}
+	// synced once it's done
+	store.SetSyncWrites(false)
+	// baseline is as old as the latest pack in it, so rollback keeps it
+	var renderedAt = time.Now()
+	var entries = old.Entries()
+	if i := sort.Search(len(entries), func(i int) bool { return entries[i].Offset >= end }); i > 0 {
+		renderedAt = time.Unix(0, entries[i-1].Timestamp)
+	}
+	err = History.ReadFrames(bytes.NewReader(baseline), func(frame []byte) error {
+		_, err := store.WriteAt(frame, renderedAt)
+		return err
+	})
+	if err == nil {
+		err = old.CopyPacks(store, end, old.Size())
+	}
+	if err == nil {
+		err = store.Sync()
+	}
+	if err != nil {
+		store.Remove()
+		return "", err
+	}
+	// strokes in baseline cannot be undone
+	var strokes = r.strokes.shift(end, int64(len(baseline))-end)
+	r.swap(store, signature)
+	r.strokes = strokes
+	// baseline is as good as a snapshot
+	atomic.StoreInt64(&r.snapshotAt, int64(len(baseline)))
+	atomic.StoreInt64(&r.compactedSize, store.Size())
+	return signature, nil
+}
+
+// ShouldCompact tells if history grows beyond threshold, and doubles since
+// the last compaction, so that a large canvas doesn't compact all the time.
+func (r *Radio) ShouldCompact(threshold int64) bool {
+	if threshold <= 0 || atomic.LoadInt32(&r.rebuilding) != 0 {
+		return false
+	}
+	var size = r.FileSize()
+	return size >= threshold && size >= 2*atomic.LoadInt64(&r.compactedSize)
+}
+
+// packMove tells where a pack of old history goes in the new one, -1 if it's
+// removed.
+type packMove struct {
+	entry     History.Entry
+	newOffset int64
+}
+
+// Rewrite replaces history with packs that keep returns true for, under a
+// new signature. Chunks queued for clients are moved to the new history, so
+// clients needn't download again.
+func (r *Radio) Rewrite(keep func(entry History.Entry, frame []byte) bool) (string, error) {
+	if !atomic.CompareAndSwapInt32(&r.rebuilding, 0, 1) {
+		return "", ErrRebuilding
+	}
+	defer atomic.StoreInt32(&r.rebuilding, 0)
+	return r.rewrite(keep)
+}
+
+type undoRequest struct {
+	userId string
+	done   chan undoResult
+}
+
+type undoResult struct {
+	offset    int64
+	signature string
+	err       error
+}
+
+// Undo removes the latest pack recorded for userId from history, under a
+// new signature. offset is where the pack was in the old history.
+// Undos requested while history is being rewritten are done together in
+// the next rewrite, so they share a signature. Other rebuilds are waited
+// for rather than failed.
+func (r *Radio) Undo(userId string) (offset int64, signature string, err error) {
+	var done = make(chan undoResult, 1)
+	r.locker.Lock()
+	r.undos = append(r.undos, undoRequest{userId, done})
+	if !r.undoing {
+		r.undoing = true
+		go r.serveUndos()
+	}
+	r.locker.Unlock()
+	var result = <-done
+	return result.offset, result.signature, result.err
+}
+
+// serveUndos does undos requested in batches, until none is left.
+func (r *Radio) serveUndos() {
+	for {
+		var err = r.waitRebuilding()
+		r.locker.Lock()
+		var batch = r.undos
+		r.undos = nil
+		if len(batch) == 0 {
+			r.undoing = false
+		}
+		r.locker.Unlock()
+		if err == nil {
+			r.undoBatch(batch)
+			atomic.StoreInt32(&r.rebuilding, 0)
+		} else {
+			for _, req := range batch {
+				req.done <- undoResult{err: err}
+			}
+		}
+		if len(batch) == 0 {
+			return
+		}
+	}
+}
+
+// waitRebuilding takes r.rebuilding, once others are done with it.
+func (r *Radio) waitRebuilding() error {
+	var deadline = time.Now().Add(UNDO_WAIT)
+	for !atomic.CompareAndSwapInt32(&r.rebuilding, 0, 1) {
+		select {
+		case <-r.GoingClose:
+			return ErrClosed
+		default:
+		}
+		if time.Now().After(deadline) {
+			return ErrRebuilding
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return nil
+}
+
+// undoBatch removes the latest pack of each user in batch in one rewrite,
+// and those before it for users asking more than once.
+func (r *Radio) undoBatch(batch []undoRequest) {
+	var offsets = make([]int64, len(batch))
+	var removed = make(map[int64]bool)
+	var undone = make(map[string]int)
+	r.locker.Lock()
+	for i, req := range batch {
+		offset, ok := r.strokes.latest(req.userId, undone[req.userId])
+		if !ok {
+			offsets[i] = -1
+			continue
+		}
+		undone[req.userId]++
+		offsets[i] = offset
+		removed[offset] = true
+	}
+	r.locker.Unlock()
+
+	var signature string
+	var err error
+	if len(removed) > 0 {
+		signature, err = r.rewrite(func(entry History.Entry, frame []byte) bool {
+			return !removed[entry.Offset]
+		})
+	}
+	for i, req := range batch {
+		if offsets[i] < 0 {
+			req.done <- undoResult{err: ErrNothingToUndo}
+		} else if err != nil {
+			req.done <- undoResult{err: err}
+		} else {
+			req.done <- undoResult{offsets[i], signature, nil}
+		}
+	}
+}
+
+// Purge removes packs recorded for userId, and those match returns true for,
+// under a new signature.
+func (r *Radio) Purge(userId string, match func(entry History.Entry, frame []byte) bool) (string, error) {
+	if !atomic.CompareAndSwapInt32(&r.rebuilding, 0, 1) {
+		return "", ErrRebuilding
+	}
+	defer atomic.StoreInt32(&r.rebuilding, 0)
+
+	var recorded = make(map[int64]bool)
+	r.locker.Lock()
+	for _, offset := range r.strokes[userId] {
+		recorded[offset] = true
+	}
+	r.locker.Unlock()
+	return r.rewrite(func(entry History.Entry, frame []byte) bool {
+		return !recorded[entry.Offset] && !match(entry, frame)
+	})
+}
+
+// Rollback truncates history right before the first pack recorded after at,
+// under a new signature.
+func (r *Radio) Rollback(at time.Time) (string, error) {
+	var cut bool
+	return r.Rewrite(func(entry History.Entry, frame []byte) bool {
+		if entry.Timestamp > at.UnixNano() {
+			cut = true
+		}
+		return !cut
+	})
+}
+
+// rewrite is Rewrite, with r.rebuilding held.
+func (r *Radio) rewrite(keep func(entry History.Entry, frame []byte) bool) (string, error) {
+	var old = r.currentStore()
+	var signature = genArchiveSign(r.Signature())
+	store, err := History.Open(filepath.Join(r.dataDir, signature), History.DEFAULT_SEGMENT_SIZE)
+	if err != nil {
+		return "", err
+	}
+	// synced once it's done
+	store.SetSyncWrites(false)
+	var moves = make([]packMove, 0)
+	var copyPack = func(entry History.Entry, frame []byte) error {
+		select {
+		case <-r.GoingClose:
+			return ErrClosed
+		default:
+		}
+		var move = packMove{entry, -1}
+		if keep(entry, frame) {
+			offset, err := store.WriteAt(frame, time.Unix(0, entry.Timestamp))
+			if err != nil {
+				return err
+			}
+			move.newOffset = offset
+		}
+		moves = append(moves, move)
+		return nil
+	}
+	var end = old.End()
+	if err := old.Packs(0, end, copyPack); err != nil {
+		store.Remove()
+		return "", err
+	}
+
+	// what's recorded meanwhile
+	r.locker.Lock()
+	defer r.locker.Unlock()
+	if r.closed {
+		// nobody would remove it otherwise
+		store.Remove()
+		return "", ErrClosed
+	}
+	if old != r.currentStore() {
+		store.Remove()
+		return "", ErrRebuilding
+	}
+	err = old.Packs(end, old.End(), copyPack)
+	if err == nil {
+		err = store.Sync()
+	}
+	if err != nil {
+		store.Remove()
+		return "", err
+	}
+	for _, v := range r.clients {
+		v.list.remap(func(chunk FileChunk, first bool) []RadioChunk {
+			return moveChunk(chunk, first, moves, old)
+		})
+	}
+	r.strokes = r.strokes.remap(moves)
+	r.replace(store, signature)
+	return signature, nil
+}
+
+// moveChunk finds where bytes of chunk go in the new history. Removed packs
+// are dropped, unless client has got head of the pack already, which can
+// only happen to the first chunk in queue.
+func moveChunk(chunk FileChunk, first bool, moves []packMove, old *History.Store) []RadioChunk {
+	var result = make([]RadioChunk, 0)
+	var end = chunk.Start + chunk.Length
+	var i = sort.Search(len(moves), func(i int) bool {
+		return moves[i].entry.Offset+moves[i].entry.Length > chunk.Start
+	})
+	for ; i < len(moves) && moves[i].entry.Offset < end; i++ {
+		var move = moves[i]
+		var from, to = move.entry.Offset, move.entry.Offset + move.entry.Length
+		if from < chunk.Start {
+			from = chunk.Start
+		}
+		if to > end {
+			to = end
+		}
+		if move.newOffset >= 0 {
+			result = append(result, FileChunk{move.newOffset + from - move.entry.Offset, to - from})
+		} else if first && from > move.entry.Offset {
+			var rest = make([]byte, to-from)
+			if _, err := old.ReadAt(rest, from); err == nil {
+				result = append(result, RAMChunk{rest})
+			}
+		}
+	}
+	return result
+}
@@ -0,0 +1,51 @@
+package Radio
+
+import "sort"
+
+// strokes indexes offsets of packs by users who draw them, oldest first.
+// Only packs recorded since the radio is made are indexed, since users get
+// new ids once they login again anyway.
+type strokes map[string][]int64
+
+func (s strokes) add(userId string, offset int64) {
+	s[userId] = append(s[userId], offset)
+}
+
+// latest finds the latest pack of userId, except the last skip ones.
+func (s strokes) latest(userId string, skip int) (int64, bool) {
+	var offsets = s[userId]
+	if len(offsets) <= skip {
+		return 0, false
+	}
+	return offsets[len(offsets)-1-skip], true
+}
+
+// remap moves offsets to where packs go in rewritten history, and drops
+// removed ones.
+func (s strokes) remap(moves []packMove) strokes {
+	var result = make(strokes)
+	for userId, offsets := range s {
+		for _, offset := range offsets {
+			var i = sort.Search(len(moves), func(i int) bool {
+				return moves[i].entry.Offset >= offset
+			})
+			if i < len(moves) && moves[i].entry.Offset == offset && moves[i].newOffset >= 0 {
+				result.add(userId, moves[i].newOffset)
+			}
+		}
+	}
+	return result
+}
+
+// shift moves offsets from start on by delta, and drops those before start.
+func (s strokes) shift(start, delta int64) strokes {
+	var result = make(strokes)
+	for userId, offsets := range s {
+		for _, offset := range offsets {
+			if offset >= start {
+				result.add(userId, offset+delta)
+			}
+		}
+	}
+	return result
+}
@@ -2,20 +2,41 @@ package Radio
 
 import (
 	"encoding/hex"
+	"errors"
 	xxhash "github.com/cespare/xxhash"
 	"github.com/dustin/randbo"
 	"log"
-	"server/pkg/BufferedFile"
+	"server/pkg/History"
 	"server/pkg/Socket"
 	"strconv"
+	"time"
 )
 
 const (
 	CHUNK_SIZE          int64 = 1024 * 400 // Bytes
 	MAX_CHUNKS_IN_QUEUE       = 2048       // which means there shuold be 2048 RadioChunk instances in pending queue at most
-	SEND_INTERVAL             = 500        // check pending list every 800ms to send new items
+
+	DEFAULT_MAX_QUEUE_BYTES  int64 = 1024 * 1024 * 8 // Bytes behind live, archive excluded
+	DEFAULT_MAX_QUEUE_CHUNKS       = MAX_CHUNKS_IN_QUEUE
+
+	READ_RETRY_INTERVAL = 50 * time.Millisecond // doubles on each retry
+	READ_RETRY_TIMES    = 8                     // about 13 seconds in all
+
+	UNDO_WAIT = 10 * time.Second // for history rebuilt by others than undo
 )
 
+// What to do with a client falls too far behind.
+const (
+	SLOW_CLIENT_DROP       = "drop"       // drop live messages, and disconnect if still too far behind
+	SLOW_CLIENT_DISCONNECT = "disconnect" // disconnect at once
+)
+
+var errUnreadable = errors.New("chunk cannot be read from history")
+var ErrNothingToUndo = errors.New("nothing to undo")
+var ErrRebuilding = errors.New("history is being rebuilt")
+var ErrClosed = errors.New("radio is closed")
+var errHistoryReplaced = errors.New("history is replaced")
+
 func (r *RadioTaskList) Tasks() *[]RadioChunk {
 	return &(r.tasks)
 }
@@ -24,7 +45,46 @@ func (r *RadioTaskList) Length() int {
 	return len(r.tasks)
 }
 
+// Size is the bytes of all chunks in list.
+func (r *RadioTaskList) Size() int64 {
+	return r.size
+}
+
+// Backlog tells how far behind live the list is. Archive requested at
+// AddClient is at front of the list, and isn't counted.
+func (r *RadioTaskList) Backlog() (int64, int) {
+	r.locker.Lock()
+	defer r.locker.Unlock()
+	var chunks = len(r.tasks) - r.historyChunks
+	if chunks < 0 {
+		chunks = 0
+	}
+	return r.size - r.history, chunks
+}
+
+func (r *RadioTaskList) Clear() {
+	r.locker.Lock()
+	defer r.locker.Unlock()
+	r.tasks = r.tasks[:0]
+	r.size = 0
+	r.history = 0
+	r.historyChunks = 0
+}
+
+func chunkSize(chunk RadioChunk) int64 {
+	switch chunk := chunk.(type) {
+	case FileChunk:
+		return chunk.Length
+	case RAMChunk:
+		return int64(len(chunk.Data))
+	}
+	return 0
+}
+
 func (r *RadioTaskList) Append(chunks []RadioChunk) {
+	for _, chunk := range chunks {
+		r.size += chunkSize(chunk)
+	}
 	r.tasks = append(r.tasks, chunks...)
 }
 
@@ -35,12 +95,24 @@ func (r *RadioTaskList) PushBack(chunks []RadioChunk) {
 func (r *RadioTaskList) PopBack() RadioChunk {
 	var bottomItem = r.tasks[len(r.tasks)-1]
 	r.tasks = r.tasks[:len(r.tasks)-1]
+	r.size -= chunkSize(bottomItem)
 	return bottomItem
 }
 
 func (r *RadioTaskList) PopFront() RadioChunk {
 	var item = r.tasks[0]
 	r.tasks = r.tasks[1:len(r.tasks)]
+	r.size -= chunkSize(item)
+	// archive goes first
+	if r.history > 0 {
+		r.history -= chunkSize(item)
+		if r.history < 0 {
+			r.history = 0
+		}
+	}
+	if r.historyChunks > 0 {
+		r.historyChunks--
+	}
 	return item
 }
 
@@ -48,6 +120,7 @@ func (r *RadioTaskList) PushFront(chunk RadioChunk) {
 	r.tasks = append(r.tasks, chunk)
 	copy(r.tasks[1:], r.tasks[0:])
 	r.tasks[0] = chunk
+	r.size += chunkSize(chunk)
 }
 
 func splitChunk(chunk FileChunk) []RadioChunk {
@@ -83,9 +156,43 @@ func pushRamChunk(chunk RAMChunk, queue *RadioTaskList) {
 	queue.Append([]RadioChunk{chunk})
 }
 
+// remap replaces every FileChunk with what fn returns, once history is
+// rewritten. first tells if chunk is the first one in list.
+func (r *RadioTaskList) remap(fn func(chunk FileChunk, first bool) []RadioChunk) {
+	r.locker.Lock()
+	defer r.locker.Unlock()
+	var tasks = r.tasks
+	var history, historyChunks = r.history, r.historyChunks
+	r.tasks = make([]RadioChunk, 0, len(tasks))
+	r.size = 0
+	for i, task := range tasks {
+		chunk, ok := task.(FileChunk)
+		if !ok {
+			appendChunk(task, r)
+			continue
+		}
+		for _, moved := range fn(chunk, i == 0) {
+			appendChunk(moved, r)
+		}
+	}
+	// archive can only be smaller
+	if history > r.size {
+		history = r.size
+	}
+	if historyChunks > len(r.tasks) {
+		historyChunks = len(r.tasks)
+	}
+	r.history, r.historyChunks = history, historyChunks
+}
+
 func appendToPendings(chunk RadioChunk, list *RadioTaskList) {
 	list.locker.Lock()
 	defer list.locker.Unlock()
+	appendChunk(chunk, list)
+}
+
+// appendChunk is appendToPendings with list locked.
+func appendChunk(chunk RadioChunk, list *RadioTaskList) {
 	switch chunk.(type) {
 	case RAMChunk:
 		pushRamChunk(chunk.(RAMChunk), list)
@@ -93,7 +200,9 @@ func appendToPendings(chunk RadioChunk, list *RadioTaskList) {
 	}
 	var chunkF = chunk.(FileChunk)
 
-	if list.Length() > 0 {
+	// archive chunks are counted in history, and live ones are never merged
+	// into them, so history and historyChunks stay in step
+	if list.Length() > list.historyChunks {
 		var bottomItem = list.PopBack()
 		switch bottomItem.(type) {
 		case FileChunk:
@@ -123,32 +232,38 @@ func appendToPendings(chunk RadioChunk, list *RadioTaskList) {
 	}
 }
 
-func fetchAndSend(client *Socket.SocketClient, list *RadioTaskList, file *BufferedFile.BufferedFile) error {
+// fetchAndSend sends the first chunk in list, and tells if there's more to
+// send. Socket write happens out of list lock, so queueing never waits for
+// a slow client.
+func fetchAndSend(client *Socket.SocketClient, list *RadioTaskList, store func() *History.Store) (bool, error) {
 	list.locker.Lock()
-	defer list.locker.Unlock()
 	if list.Length() <= 0 {
-		return nil
+		list.locker.Unlock()
+		return false, nil
 	}
 
-	var item = list.PopFront()
+	var buf []byte
+	var item = list.tasks[0]
 
 	switch item.(type) {
 	case FileChunk:
 		var item = item.(FileChunk)
-		var buf = make([]byte, item.Length)
-		length, err := file.ReadAt(buf, item.Start)
+		buf = make([]byte, item.Length)
+		length, err := store().ReadAt(buf, item.Start)
 		if int64(length) != item.Length || err != nil {
-			// move back
-			list.PushFront(item)
-			return nil
+			// leave it there, and retry later
+			list.locker.Unlock()
+			return false, errUnreadable
 		}
-		_, err = client.WriteRaw(buf)
-		return err
 	case RAMChunk:
-		_, err := client.WriteRaw(item.(RAMChunk).Data)
-		return err
+		buf = item.(RAMChunk).Data
 	}
-	return nil
+	list.PopFront()
+	var more = list.Length() > 0
+	list.locker.Unlock()
+
+	_, err := client.WriteRaw(buf)
+	return more, err
 }
 
 func genArchiveSign(name string) string {
@@ -5,6 +5,39 @@ type ClearAllAction struct {
 	Signature string `json:"signature"`
 }
 
+type RollbackAction struct {
+	Action    string `json:"action"`
+	Timestamp int64  `json:"timestamp"`
+	Signature string `json:"signature"`
+}
+
+type ClearLayerAction struct {
+	Action    string `json:"action"`
+	Layer     string `json:"layer"`
+	Signature string `json:"signature"`
+	Offset    int64  `json:"offset"`
+}
+
+type UndoAction struct {
+	Action    string `json:"action"`
+	UserId    string `json:"userid"`
+	Id        int64  `json:"id"`
+	Signature string `json:"signature"`
+	Offset    int64  `json:"offset"`
+}
+
+type PurgeUserAction struct {
+	Action    string `json:"action"`
+	ClientId  string `json:"clientid"`
+	Name      string `json:"name"`
+	Signature string `json:"signature"`
+}
+
+type CompactAction struct {
+	Action    string `json:"action"`
+	Signature string `json:"signature"`
+}
+
 type CloseActionInfo struct {
 	Reason int64 `json:"reason"`
 }
@@ -14,10 +47,25 @@ type CloseAction struct {
 	Info   CloseActionInfo `json:"info"`
 }
 
+type DisconnectActionInfo struct {
+	Reason int64 `json:"reason"`
+}
+
+type DisconnectAction struct {
+	Action string               `json:"action"`
+	Info   DisconnectActionInfo `json:"info"`
+}
+
 type KickAction struct {
 	Action string `json:"action"`
 }
 
+// UndeliveredAction tells sender that a private message is not delivered.
+type UndeliveredAction struct {
+	Action string `json:"action"`
+	To     string `json:"to"`
+}
+
 type NotifyAction struct {
 	Action  string `json:"action"`
 	Content string `json:"content"`
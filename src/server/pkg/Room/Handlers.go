@@ -1,11 +1,17 @@
 package Room
 
 import (
+	"encoding/base64"
 	"encoding/json"
 	"log"
+	"path/filepath"
+	"server/pkg/Canvas"
+	"server/pkg/Config"
 	"server/pkg/ErrorCode"
 	"server/pkg/Radio"
 	"server/pkg/Socket"
+	"strings"
+	"sync/atomic"
 	"time"
 )
 
@@ -15,18 +21,18 @@ func (m *Room) sendCommandTo(resp interface{}, client *Socket.SocketClient) {
 		panic(err)
 	}
 
-	m.sendTo(raw, Socket.PackHeader{
-		true,
-		Socket.COMMAND,
-	}, client)
+	m.sendTo(raw, client.HeaderFor(Socket.COMMAND, len(raw)), client)
 }
 
 func (m *Room) sendTo(data []byte, header Socket.PackHeader, client *Socket.SocketClient) {
 	raw := Socket.AssamblePack(header, data)
 
-	m.radio.SingleSendChan <- Radio.RadioSingleSendPart{
+	select {
+	case m.radio.SingleSendChan <- Radio.RadioSingleSendPart{
 		Data:   raw,
 		Client: client,
+	}:
+	case <-m.GoingClose:
 	}
 }
 
@@ -52,6 +58,13 @@ func directSendMessage(resp interface{}, client *Socket.SocketClient) {
 	}
 }
 
+func (m *Room) handleHello(data []byte, client *Socket.SocketClient) {
+	req := &Socket.HelloRequest{}
+	json.Unmarshal(data, &req)
+
+	directSendCommand(client.AnswerHello(req), client)
+}
+
 func (m *Room) handleJoin(data []byte, client *Socket.SocketClient) {
 	req := &JoinRoomRequest{}
 	json.Unmarshal(data, &req)
@@ -180,10 +193,28 @@ func (m *Room) handleArchive(data []byte, client *Socket.SocketClient) {
 		Errcode:    0,
 	}
 
+	// snapshot is only worth it when it saves something
+	var heads [][]byte
+	if req.Snapshot {
+		offset, snapshot, err := m.radio.LatestSnapshot()
+		if err != nil {
+			log.Println("cannot read snapshot", err)
+		} else if snapshot != nil && offset > startPos && offset <= realLength {
+			startPos = offset
+			dataLength = realLength - offset
+			resp.DataLength = dataLength
+			resp.Snapshot = &ArchiveSnapshotInfo{
+				Offset:     offset,
+				DataLength: int64(len(snapshot)),
+			}
+			heads = append(heads, snapshot)
+		}
+	}
+
 	directSendCommand(resp, client)
 
 	if resp.Result {
-		m.radio.AddClient(client, startPos, dataLength)
+		m.radio.AddClient(client, startPos, dataLength, heads...)
 	}
 }
 
@@ -204,7 +235,8 @@ func (m *Room) handleClearAll(data []byte, client *Socket.SocketClient) {
 		return
 	}
 
-	m.archiveSign = m.radio.Prune()
+	m.radio.Prune()
+	m.archiveSignChanged()
 
 	var action = ClearAllAction{
 		Action:    "clearall",
@@ -216,6 +248,236 @@ func (m *Room) handleClearAll(data []byte, client *Socket.SocketClient) {
 	m.broadcastCommand(action)
 }
 
+func (m *Room) handleRollback(data []byte, client *Socket.SocketClient) {
+	if !m.hasUser(client) {
+		return
+	}
+	req := &RollbackRequest{}
+	json.Unmarshal(data, &req)
+
+	var resp = RollbackResponse{
+		Response: "rollback",
+		Result:   false,
+	}
+
+	if req.Key != m.Key() || req.Timestamp <= 0 {
+		m.sendCommandTo(resp, client)
+		return
+	}
+
+	// rewriting takes a while
+	m.runTask(func() {
+		signature, err := m.rollback(time.Unix(req.Timestamp, 0))
+		if err == nil {
+			resp.Result = true
+			resp.Signature = signature
+		}
+		m.sendCommandTo(resp, client)
+	})
+}
+
+func (m *Room) handleClearLayer(data []byte, client *Socket.SocketClient) {
+	if !m.hasUser(client) {
+		return
+	}
+	req := &ClearLayerRequest{}
+	json.Unmarshal(data, &req)
+
+	var resp = ClearLayerResponse{
+		Response: "clearlayer",
+		Result:   false,
+	}
+
+	if req.Key != m.Key() || len(req.Layer) <= 0 {
+		m.sendCommandTo(resp, client)
+		return
+	}
+
+	// rewriting takes a while
+	m.runTask(func() {
+		signature, err := m.clearLayer(req.Layer)
+		if err == nil {
+			resp.Result = true
+			resp.Signature = signature
+		}
+		m.sendCommandTo(resp, client)
+	})
+}
+
+func (m *Room) handleUndo(data []byte, client *Socket.SocketClient) {
+	var user = m.userOf(client)
+	if user == nil {
+		return
+	}
+	var userId = user.clientId
+	var resp = UndoResponse{
+		Response: "undo",
+		Result:   false,
+		Errcode:  ErrorCode.UNDO_UNKNOWN,
+	}
+
+	// each rewrite copies the whole history
+	var interval = time.Duration(Config.ReadConfInt("undo_interval", DEFAULT_UNDO_INTERVAL)) * time.Millisecond
+	var now = time.Now().UnixNano()
+	var last = atomic.LoadInt64(&user.lastUndo)
+	if now-last < int64(interval) || !atomic.CompareAndSwapInt64(&user.lastUndo, last, now) {
+		resp.Errcode = ErrorCode.UNDO_TOO_FAST
+		m.sendCommandTo(resp, client)
+		return
+	}
+
+	// rewriting takes a while
+	m.runTask(func() {
+		offset, signature, err := m.radio.Undo(userId)
+		if err != nil {
+			switch err {
+			case Radio.ErrNothingToUndo:
+				resp.Errcode = ErrorCode.UNDO_NOTHING
+			case Radio.ErrRebuilding:
+				resp.Errcode = ErrorCode.UNDO_BUSY
+			default:
+				log.Println("cannot undo in room", m.Options.Name, err)
+			}
+			m.sendCommandTo(resp, client)
+			return
+		}
+		m.archiveSignChanged()
+		// after data queued before
+		m.queueRewriteCommand(func(received int64) interface{} {
+			return UndoAction{
+				Action:    "undo",
+				UserId:    userId,
+				Id:        offset,
+				Signature: signature,
+				Offset:    received,
+			}
+		})
+		resp.Result = true
+		resp.Errcode = 0
+		resp.Id = offset
+		resp.Signature = signature
+		m.sendCommandTo(resp, client)
+	})
+}
+
+func (m *Room) handlePurgeUser(data []byte, client *Socket.SocketClient) {
+	if !m.hasUser(client) {
+		return
+	}
+	req := &PurgeUserRequest{}
+	json.Unmarshal(data, &req)
+
+	var resp = PurgeUserResponse{
+		Response: "purgeuser",
+		Result:   false,
+	}
+
+	if req.Key != m.Key() || (len(req.ClientId) <= 0 && len(req.Name) <= 0) {
+		m.sendCommandTo(resp, client)
+		return
+	}
+
+	// rewriting takes a while
+	m.runTask(func() {
+		signature, err := m.purgeUser(req.ClientId, req.Name)
+		if err == nil {
+			resp.Result = true
+			resp.Signature = signature
+		}
+		m.sendCommandTo(resp, client)
+	})
+}
+
+func (m *Room) handleCompact(data []byte, client *Socket.SocketClient) {
+	if !m.hasUser(client) {
+		return
+	}
+	req := &CompactRequest{}
+	json.Unmarshal(data, &req)
+
+	var resp = CompactResponse{
+		Response: "compact",
+		Result:   false,
+	}
+
+	if req.Key != m.Key() {
+		m.sendCommandTo(resp, client)
+		return
+	}
+
+	// rendering takes a while
+	m.runTask(func() {
+		signature, err := m.compactHistory()
+		if err == nil {
+			resp.Result = true
+			resp.Signature = signature
+		}
+		m.sendCommandTo(resp, client)
+	})
+}
+
+func (m *Room) handleExport(data []byte, client *Socket.SocketClient) {
+	if !m.hasUser(client) {
+		return
+	}
+	req := &ExportRequest{}
+	json.Unmarshal(data, &req)
+
+	var resp = ExportResponse{
+		Response: "export",
+		Result:   false,
+		Format:   req.Format,
+		Offset:   req.Offset,
+		Errcode:  ErrorCode.EXPORT_UNKNOWN,
+	}
+
+	if req.Key != m.Key() {
+		resp.Errcode = ErrorCode.EXPORT_KEY_INCORRECT
+		m.sendCommandTo(resp, client)
+		return
+	}
+
+	if req.Format != Canvas.FORMAT_PNG && req.Format != Canvas.FORMAT_ORA {
+		resp.Errcode = ErrorCode.EXPORT_INVALID_FORMAT
+		m.sendCommandTo(resp, client)
+		return
+	}
+
+	// rendering takes a while
+	m.runTask(func() {
+		var name = m.exportName(req.Format)
+		if req.Offset == 0 {
+			if err := m.exportHistory(name, req.Format); err == errExporting {
+				resp.Errcode = ErrorCode.EXPORT_BUSY
+				m.sendCommandTo(resp, client)
+				return
+			} else if err != nil {
+				log.Println("cannot export room", m.Options.Name, err)
+				m.sendCommandTo(resp, client)
+				return
+			}
+		} else if base := filepath.Base(req.Path); strings.HasSuffix(base, "."+req.Format) {
+			// the file first piece comes from, even if others export later,
+			// looked up in exports of this room only
+			name = filepath.Join(m.exportDir(), base)
+		} else if latest, ok := m.exports.Load(req.Format); ok {
+			name = latest.(string)
+		}
+		piece, size, err := readExport(name, req.Offset)
+		if err != nil {
+			resp.Errcode = ErrorCode.EXPORT_OUT_OF_RANGE
+			m.sendCommandTo(resp, client)
+			return
+		}
+		resp.Result = true
+		resp.Errcode = 0
+		resp.Path = filepath.Join(EXPORT_DIR, filepath.Base(name))
+		resp.Size = size
+		resp.Data = base64.StdEncoding.EncodeToString(piece)
+		m.sendCommandTo(resp, client)
+	})
+}
+
 func (m *Room) handleCheckout(data []byte, client *Socket.SocketClient) {
 	if !m.hasUser(client) {
 		return
@@ -1,48 +1,86 @@
 package Room
 
 type JoinRoomRequest struct {
-	Request  string `json: "request"`
-	Password string `json: "password"`
-	Name     string `json: "name"`
+	Request  string `json:"request"`
+	Password string `json:"password"`
+	Name     string `json:"name"`
+	Room     string `json:"room"`
 }
 
 type HeartbeatRequest struct {
-	Request   string `json: "request"`
-	Timestamp int64  `json: "timestamp"`
+	Request   string `json:"request"`
+	Timestamp int64  `json:"timestamp"`
 }
 
 type ArchiveSignRequest struct {
-	Request string `json: "request"`
+	Request string `json:"request"`
 }
 
 type ArchiveRequest struct {
-	Request    string `json: "request"`
+	Request    string `json:"request"`
 	Start      int64  `json:"start"`
 	DataLength int64  `json:"datalength"`
+	Snapshot   bool   `json:"snapshot"`
 }
 
 type ClearAllRequest struct {
-	Request string `json: "request"`
+	Request string `json:"request"`
 	Key     string `json:"key"`
 }
 
+type RollbackRequest struct {
+	Request   string `json:"request"`
+	Key       string `json:"key"`
+	Timestamp int64  `json:"timestamp"`
+}
+
+type ClearLayerRequest struct {
+	Request string `json:"request"`
+	Key     string `json:"key"`
+	Layer   string `json:"layer"`
+}
+
+type UndoRequest struct {
+	Request string `json:"request"`
+}
+
+type PurgeUserRequest struct {
+	Request  string `json:"request"`
+	Key      string `json:"key"`
+	ClientId string `json:"clientid"`
+	Name     string `json:"name"`
+}
+
+type CompactRequest struct {
+	Request string `json:"request"`
+	Key     string `json:"key"`
+}
+
+type ExportRequest struct {
+	Request string `json:"request"`
+	Key     string `json:"key"`
+	Format  string `json:"format"`
+	Offset  int64  `json:"offset"`
+	Path    string `json:"path"` // from the first response, for the same file
+}
+
 type KickRequest struct {
-	Request  string `json: "request"`
-	Key      string `json: "key"`
-	ClientId string `json: "clientid"`
+	Request  string `json:"request"`
+	Key      string `json:"key"`
+	ClientId string `json:"clientid"`
 }
 
 type CloseRequest struct {
-	Request string `json: "request"`
-	Key     string `json: "key"`
+	Request string `json:"request"`
+	Key     string `json:"key"`
 }
 
 type CheckoutRequest struct {
-	Request string `json: "request"`
-	Key     string `json: "key"`
+	Request string `json:"request"`
+	Key     string `json:"key"`
 }
 
 type OnlineListRequest struct {
-	Request  string `json: "request"`
-	ClientId string `json: "clientid"`
+	Request  string `json:"request"`
+	ClientId string `json:"clientid"`
 }
@@ -31,12 +31,18 @@ type ArchiveSignResponse struct {
 	Errcode   int64  `json:"errcode"`
 }
 
+type ArchiveSnapshotInfo struct {
+	Offset     int64 `json:"offset"`
+	DataLength int64 `json:"datalength"`
+}
+
 type ArchiveResponse struct {
-	Response   string `json:"response"`
-	Result     bool   `json:"result"`
-	Signature  string `json:"signature"`
-	DataLength int64  `json:"datalength"`
-	Errcode    int64  `json:"errcode"`
+	Response   string               `json:"response"`
+	Result     bool                 `json:"result"`
+	Signature  string               `json:"signature"`
+	DataLength int64                `json:"datalength"`
+	Snapshot   *ArchiveSnapshotInfo `json:"snapshot,omitempty"`
+	Errcode    int64                `json:"errcode"`
 }
 
 type ClearAllResponse struct {
@@ -44,6 +50,49 @@ type ClearAllResponse struct {
 	Result   bool   `json:"result"`
 }
 
+type RollbackResponse struct {
+	Response  string `json:"response"`
+	Result    bool   `json:"result"`
+	Signature string `json:"signature"`
+}
+
+type ClearLayerResponse struct {
+	Response  string `json:"response"`
+	Result    bool   `json:"result"`
+	Signature string `json:"signature"`
+}
+
+type UndoResponse struct {
+	Response  string `json:"response"`
+	Result    bool   `json:"result"`
+	Id        int64  `json:"id"`
+	Signature string `json:"signature"`
+	Errcode   int64  `json:"errcode"`
+}
+
+type PurgeUserResponse struct {
+	Response  string `json:"response"`
+	Result    bool   `json:"result"`
+	Signature string `json:"signature"`
+}
+
+type CompactResponse struct {
+	Response  string `json:"response"`
+	Result    bool   `json:"result"`
+	Signature string `json:"signature"`
+}
+
+type ExportResponse struct {
+	Response string `json:"response"`
+	Result   bool   `json:"result"`
+	Format   string `json:"format"`
+	Path     string `json:"path"`
+	Offset   int64  `json:"offset"`
+	Size     int64  `json:"size"`
+	Data     string `json:"data"`
+	Errcode  int64  `json:"errcode"`
+}
+
 type KickResponse struct {
 	Response string `json:"response"`
 	Result   bool   `json:"result"`
@@ -6,17 +6,30 @@ import (
 	"net"
 	"os"
 	"path"
-	"path/filepath"
+	"server/pkg/Canvas"
 	"server/pkg/Config"
+	"server/pkg/ErrorCode"
+	"server/pkg/History"
 	"server/pkg/Radio"
 	"server/pkg/Router"
 	"server/pkg/Socket"
-	"strconv"
 	"sync"
 	"sync/atomic"
 	"time"
 )
 
+const (
+	DEFAULT_SNAPSHOT_INTERVAL  = 4 * 1024 * 1024 // Bytes of history between snapshots
+	DEFAULT_COMPACT_THRESHOLD  = 0               // Bytes of history before compaction, off for legacy clients
+	DEFAULT_MAX_REJECTED_PACKS = 16              // Bad DATA packs before a client is kicked
+	DEFAULT_UNDO_INTERVAL      = 1000            // Milliseconds between undo of a user
+	DEFAULT_EXPORT_RETENTION   = 168             // Hours exported files are kept, 0 keeps them forever
+
+	EXPORT_DIR                 = "exports"   // under data_dir
+	EXPORT_PIECE_SIZE    int64 = 256 * 1024  // Bytes of exported file in each response
+	EXPORT_CLOSE_TIMEOUT       = time.Minute // Longest time closing room waits for the final export
+)
+
 type RoomOption struct {
 	MaxLoad    int
 	Width      int64
@@ -28,12 +41,23 @@ type RoomOption struct {
 }
 
 type RoomUser struct {
-	clientId string
-	nickName string
+	clientId      string
+	nickName      string
+	rejectedPacks int32
+	lastUndo      int64 // in unix nanoseconds
+}
+
+// RoomStats is published in /debug/vars.
+type RoomStats struct {
+	Radio.QueueStats
+	Rejected int64 `json:"rejected"`
+	Kicked   int64 `json:"kicked"`
 }
 
 type Room struct {
-	ln                  *net.TCPListener
+	ln                  net.Listener
+	wsLn                net.Listener
+	tlsLn               net.Listener
 	GoingClose          chan bool
 	router              *Router.Router
 	radio               *Radio.Radio
@@ -43,77 +67,132 @@ type Room struct {
 	key                 string
 	archiveSign         string
 	port                uint16
+	wsPort              uint16
+	tlsPort             uint16
 	Options             RoomOption
 	lastCheck           atomic.Value
+	onArchiveSign       func(room *Room)
+	rejectedPacks       int64
+	kickedClients       int64
+	exporting           int32
+	exports             sync.Map // format to name of the latest exported file
+	tasks               sync.WaitGroup
+	tasksLocker         sync.Mutex
 }
 
 func (m *Room) Close() {
+	m.tasksLocker.Lock()
 	close(m.GoingClose)
+	m.tasksLocker.Unlock()
+	// RoomManager forgets room once listeners are closed
+	m.closeListeners()
+	// rewrites in flight are cancelled, renders are waited for
 	m.radio.Close()
+	m.tasks.Wait()
+	// history is gone with room, keep what it looks like
+	m.exportAll(EXPORT_CLOSE_TIMEOUT)
 	m.radio.Remove()
+}
+
+// runTask runs fn in a new goroutine, unless room is closing. Close waits
+// for tasks, so that history is still there for them.
+func (m *Room) runTask(fn func()) {
+	m.tasksLocker.Lock()
+	defer m.tasksLocker.Unlock()
+	select {
+	case <-m.GoingClose:
+		return
+	default:
+	}
+	m.tasks.Add(1)
+	go func() {
+		defer m.tasks.Done()
+		fn()
+	}()
+}
+
+func (m *Room) closeListeners() {
 	m.ln.Close()
+	if m.wsLn != nil {
+		m.wsLn.Close()
+	}
+	if m.tlsLn != nil {
+		m.tlsLn.Close()
+	}
 }
 
 func (m *Room) init() (err error) {
 	m.GoingClose = make(chan bool)
 	m.router = Router.MakeRouter("request")
 
-	var addr *net.TCPAddr
-
-	if len(m.key) > 0 {
-		// recover
-		addr, err = net.ResolveTCPAddr("tcp",
-			":"+strconv.FormatInt(int64(m.port), 10))
-		if err != nil {
-			// handle error
-			return err
-		}
-	} else {
+	if len(m.key) <= 0 {
 		// new-create
 		var source = append([]byte(m.Options.Name),
 			[]byte(m.Options.Password)...)
 		m.key = genSignedKey(source)
-
-		addr, err = net.ResolveTCPAddr("tcp", ":0")
-		if err != nil {
-			// handle error
-			return err
-		}
 		m.archiveSign = genArchiveSign(m.Options.Name)
 	}
 
 	data_dir := Config.ReadConfString("data_dir", "./data/")
-	data_path := filepath.Join(data_dir, m.archiveSign+".data")
 
-	if os.MkdirAll(path.Join(data_dir), 0666) != nil {
+	if os.MkdirAll(path.Join(data_dir), 0755) != nil {
 		log.Println("Cannot make dir", path.Join(data_dir))
 		panic(err)
 	}
 
-	radio, err := Radio.MakeRadio(data_path, m.archiveSign)
+	radio, err := Radio.MakeRadio(data_dir, m.archiveSign)
+	if err != nil {
+		return err
+	}
 	m.radio = radio
+	m.radio.SetQueueLimits(Radio.QueueLimits{
+		MaxBytes:  int64(Config.ReadConfInt("max_queue_bytes", int(Radio.DEFAULT_MAX_QUEUE_BYTES))),
+		MaxChunks: Config.ReadConfInt("max_queue_chunks", Radio.DEFAULT_MAX_QUEUE_CHUNKS),
+		Policy:    Config.ReadConfString("slow_client_policy", Radio.SLOW_CLIENT_DROP),
+	})
+	m.radio.OnSlowClient(m.disconnectSlowClient)
 
-	m.ln, err = net.ListenTCP("tcp", addr)
+	// port is 0 when new-created, which picks a random one
+	m.ln, m.port, err = Socket.ListenTCP(m.port)
 	if err != nil {
 		// handle error
 		// TODO: handle port already in use
 		return err
 	}
-	_, port, err := net.SplitHostPort(m.ln.Addr().String())
-	if err != nil {
-		return err
+
+	if Config.ReadConfInt("websocket_port", 0) > 0 {
+		m.wsLn, m.wsPort, err = Socket.ListenWebSocket(m.wsPort)
+		if err != nil {
+			m.ln.Close()
+			return err
+		}
 	}
-	uport, err := strconv.ParseUint(port, 10, 16)
-	m.port = uint16(uport)
+
+	tlsConfig, err := Socket.LoadTLSConfig(
+		Config.ReadConfString("tls_cert", ""),
+		Config.ReadConfString("tls_key", ""))
 	if err != nil {
-		return err
+		log.Println("Cannot load TLS certificate, TLS is disabled for room", m.Options.Name, err)
+	} else if tlsConfig != nil {
+		m.tlsLn, m.tlsPort, err = Socket.ListenTLS(m.tlsPort, tlsConfig)
+		if err != nil {
+			m.closeListeners()
+			return err
+		}
 	}
 
+	m.router.Register("hello", m.handleHello)
 	m.router.Register("login", m.handleJoin)
 	m.router.Register("heartbeat", m.handleHeartbeat)
 	m.router.Register("archivesign", m.handleArchiveSign)
 	m.router.Register("archive", m.handleArchive)
 	m.router.Register("clearall", m.handleClearAll)
+	m.router.Register("rollback", m.handleRollback)
+	m.router.Register("clearlayer", m.handleClearLayer)
+	m.router.Register("undo", m.handleUndo)
+	m.router.Register("purgeuser", m.handlePurgeUser)
+	m.router.Register("compact", m.handleCompact)
+	m.router.Register("export", m.handleExport)
 	m.router.Register("kick", m.handleKick)
 	m.router.Register("onlinelist", m.handleOnlineList)
 	m.router.Register("close", m.handleClose)
@@ -126,6 +205,20 @@ func (m *Room) Port() uint16 {
 	return m.port
 }
 
+// WebSocketPort returns 0 if WebSocket is disabled.
+func (m *Room) WebSocketPort() uint16 {
+	return m.wsPort
+}
+
+// TLSPort returns 0 if TLS is disabled.
+func (m *Room) TLSPort() uint16 {
+	return m.tlsPort
+}
+
+func (m *Room) ArchiveSign() string {
+	return m.radio.Signature()
+}
+
 func (m *Room) Key() string {
 	return m.key
 }
@@ -153,26 +246,51 @@ func (m *Room) OnlineList() (list []OnlineListItem) {
 	return list
 }
 
+// QueueStats tells how often clients fall too far behind in this room.
+func (m *Room) QueueStats() Radio.QueueStats {
+	return m.radio.QueueStats()
+}
+
+// Stats tells how often clients fall behind, or send bad packs.
+func (m *Room) Stats() RoomStats {
+	return RoomStats{
+		QueueStats: m.radio.QueueStats(),
+		Rejected:   atomic.LoadInt64(&m.rejectedPacks),
+		Kicked:     atomic.LoadInt64(&m.kickedClients),
+	}
+}
+
+// OnArchiveSignChanged is called whenever history is pruned or compacted,
+// so that new signature can be saved. Set it before Run.
+func (m *Room) OnArchiveSignChanged(handler func(room *Room)) {
+	m.onArchiveSign = handler
+}
+
+func (m *Room) archiveSignChanged() {
+	if m.onArchiveSign != nil {
+		m.onArchiveSign(m)
+	}
+}
+
 func (m *Room) Dump() []byte {
 	return dumpRoom(m)
 }
 
-func (m *Room) hasUser(u *Socket.SocketClient) bool {
-	value, ok := m.clients.Load(u)
+// userOf finds user of client, who must have logged in.
+func (m *Room) userOf(client *Socket.SocketClient) *RoomUser {
+	value, ok := m.clients.Load(client)
 	if !ok {
-		return false
+		return nil
 	}
 	user, ok := value.(*RoomUser)
-
-	if !ok {
-		return false
-	}
-
-	if len(user.clientId) > 0 {
-		return true
+	if !ok || len(user.clientId) <= 0 {
+		return nil
 	}
+	return user
+}
 
-	return false
+func (m *Room) hasUser(u *Socket.SocketClient) bool {
+	return m.userOf(u) != nil
 }
 
 func (m *Room) processEmptyClose() {
@@ -206,27 +324,49 @@ func (m *Room) processExpire() {
 
 func (m *Room) Run() error {
 	go m.processExpire()
+	if m.wsLn != nil {
+		go m.serve(m.wsLn)
+	}
+	if m.tlsLn != nil {
+		go m.serve(m.tlsLn)
+	}
+	m.serve(m.ln)
+	return nil
+}
+
+func (m *Room) serve(ln net.Listener) {
 	for {
 		select {
 		case _, _ = <-m.GoingClose:
-			return nil
+			return
 		default:
-			conn, err := m.ln.AcceptTCP()
+			conn, err := ln.Accept()
 			if err != nil {
 				// TODO: handle error
 				log.Println(err)
 				continue
 			}
-			var client = Socket.MakeSocketClient(conn)
-			m.clients.Store(client, &RoomUser{})
-			atomic.AddInt32(&m.currentClientsCount, 1)
-			m.processClient(client)
+			m.Attach(Socket.MakeSocketClient(conn))
 		}
 	}
 }
 
-func (m *Room) processClient(client *Socket.SocketClient) {
+// Attach starts serving a client, which may be accepted by room itself or
+// handed over by a shared acceptor. pendings are packages that have been
+// read from client already, and will be processed before anything else.
+func (m *Room) Attach(client *Socket.SocketClient, pendings ...Socket.Package) {
+	m.clients.Store(client, &RoomUser{})
+	atomic.AddInt32(&m.currentClientsCount, 1)
+	m.processClient(client, pendings...)
+}
+
+func (m *Room) processClient(client *Socket.SocketClient, pendings ...Socket.Package) {
 	go func() {
+		for _, pkg := range pendings {
+			if !m.processPackage(client, pkg) {
+				return
+			}
+		}
 		for {
 			select {
 			case _, _ = <-m.GoingClose:
@@ -239,37 +379,8 @@ func (m *Room) processClient(client *Socket.SocketClient) {
 					m.processEmptyClose()
 					return
 				}
-				switch pkg.PackageType {
-				case Socket.COMMAND:
-					err := m.router.OnMessage(pkg.Unpacked, client)
-					if err != nil {
-						log.Println(err)
-						m.kickClient(client)
-					}
-				case Socket.DATA:
-					if !m.hasUser(client) {
-						m.removeClient(client)
-						return
-					}
-					select {
-					case m.radio.WriteChan <- Radio.RadioSendPart{
-						Data: pkg.Repacked,
-					}:
-					case <-time.After(time.Second * 5):
-						log.Println("WriteChan failed in processClient")
-					}
-				case Socket.MESSAGE:
-					if !m.hasUser(client) {
-						m.removeClient(client)
-						return
-					}
-					select {
-					case m.radio.SendChan <- Radio.RadioSendPart{
-						Data: pkg.Repacked,
-					}:
-					case <-time.After(time.Second * 5):
-						log.Println("SendChan failed in processClient")
-					}
+				if !m.processPackage(client, pkg) {
+					return
 				}
 			case <-time.After(time.Second * 30):
 				m.kickClient(client)
@@ -279,6 +390,126 @@ func (m *Room) processClient(client *Socket.SocketClient) {
 	}()
 }
 
+// processPackage returns false if client should not be served any more.
+func (m *Room) processPackage(client *Socket.SocketClient, pkg Socket.Package) bool {
+	switch pkg.PackageType {
+	case Socket.COMMAND:
+		err := m.router.OnMessage(pkg.Unpacked, client)
+		if err != nil {
+			log.Println(err)
+			m.kickClient(client)
+		}
+	case Socket.DATA:
+		var user = m.userOf(client)
+		if user == nil {
+			m.removeClient(client)
+			return false
+		}
+		if err := m.validatePack(pkg); err != nil {
+			return m.rejectPack(client, user, err)
+		}
+		data, err := restamp(pkg, user)
+		if err != nil {
+			return true
+		}
+		select {
+		case m.radio.WriteChan <- Radio.RadioSendPart{
+			Data:   data,
+			UserId: user.clientId,
+		}:
+		case <-time.After(time.Second * 5):
+			log.Println("WriteChan failed in processClient")
+		}
+		m.radio.SnapshotIfNeeded(int(m.Options.Width), int(m.Options.Height),
+			int64(Config.ReadConfInt("snapshot_interval", DEFAULT_SNAPSHOT_INTERVAL)))
+		if m.radio.ShouldCompact(int64(Config.ReadConfInt("compact_threshold", DEFAULT_COMPACT_THRESHOLD))) {
+			m.runTask(func() {
+				m.compactHistory()
+			})
+		}
+	case Socket.MESSAGE:
+		var user = m.userOf(client)
+		if user == nil {
+			m.removeClient(client)
+			return false
+		}
+		data, err := restamp(pkg, user)
+		if err != nil {
+			return true
+		}
+		if to := recipientOf(pkg); len(to) > 0 {
+			m.sendPrivateMessage(data, client, to)
+			return true
+		}
+		select {
+		case m.radio.SendChan <- Radio.RadioSendPart{
+			Data: data,
+		}:
+		case <-time.After(time.Second * 5):
+			log.Println("SendChan failed in processClient")
+		}
+	}
+	return true
+}
+
+// sendPrivateMessage sends a MESSAGE pack to user of clientId, and sender
+// only. Sender is told if there's no such user in room, or the user cannot
+// receive it.
+func (m *Room) sendPrivateMessage(data []byte, sender *Socket.SocketClient, clientId string) {
+	var recipient = m.findClientById(clientId)
+	if recipient == nil || !m.radio.HasClient(recipient) {
+		// left, or not downloading archive yet
+		m.sendCommandTo(UndeliveredAction{
+			Action: "undelivered",
+			To:     clientId,
+		}, sender)
+		return
+	}
+	var clients = []*Socket.SocketClient{recipient}
+	if sender != recipient {
+		clients = append(clients, sender)
+	}
+	for _, client := range clients {
+		select {
+		case m.radio.SingleSendChan <- Radio.RadioSingleSendPart{
+			Data:      data,
+			Client:    client,
+			Droppable: true,
+		}:
+		case <-time.After(time.Second * 5):
+			log.Println("SingleSendChan failed in sendPrivateMessage")
+		}
+	}
+}
+
+// validatePack checks a DATA pack before it's recorded forever.
+func (m *Room) validatePack(pkg Socket.Package) error {
+	action, err := Canvas.DecodeAction(pkg.Unpacked)
+	if err != nil {
+		return err
+	}
+	return action.Validate(int(m.Options.Width), int(m.Options.Height))
+}
+
+// rejectPack drops a bad pack, and kicks client who keeps sending them. It
+// returns false if client is kicked.
+func (m *Room) rejectPack(client *Socket.SocketClient, user *RoomUser, err error) bool {
+	atomic.AddInt64(&m.rejectedPacks, 1)
+	var count = atomic.AddInt32(&user.rejectedPacks, 1)
+	var limit = Config.ReadConfInt("max_rejected_packs", DEFAULT_MAX_REJECTED_PACKS)
+	if limit <= 0 || int(count) < limit {
+		return true
+	}
+	log.Printf("%s(%s) is kicked from room %s for %d bad packs: %v\n",
+		user.nickName, user.clientId, m.Options.Name, count, err)
+	atomic.AddInt64(&m.kickedClients, 1)
+	directSendCommand(KickAction{
+		Action: "kick",
+	}, client)
+	m.kickClient(client)
+	return false
+}
+
 func (m *Room) removeClient(client *Socket.SocketClient) {
 	m.clients.Delete(client)
 	atomic.AddInt32(&m.currentClientsCount, -1)
@@ -299,6 +530,131 @@ func (m *Room) kickClient(target *Socket.SocketClient) {
 	time.AfterFunc(time.Second*10, target.Close)
 }
 
+func (m *Room) disconnectSlowClient(client *Socket.SocketClient) {
+	directSendCommand(DisconnectAction{
+		Action: "disconnect",
+		Info: DisconnectActionInfo{
+			Reason: ErrorCode.DISCONNECT_SLOW_CLIENT,
+		},
+	}, client)
+	client.Close()
+}
+
+func (m *Room) repairHistory() error {
+	v, err := m.radio.Repair()
+	if err != nil {
+		log.Println("cannot repair history of room", m.Options.Name, err)
+		return err
+	}
+	if v.Broken() {
+		log.Printf("history of room %s is repaired: %d bytes truncated, %d packs reindexed\n",
+			m.Options.Name, v.Size-v.ValidSize, v.Unindexed)
+	}
+	return nil
+}
+
+// compactHistory replaces history with a rendered baseline, and tells
+// everyone to download again.
+func (m *Room) compactHistory() (string, error) {
+	var before = m.radio.FileSize()
+	signature, err := m.radio.Compact(int(m.Options.Width), int(m.Options.Height))
+	if err == Radio.ErrRebuilding {
+		return "", err
+	}
+	if err != nil {
+		log.Println("cannot compact history of room", m.Options.Name, err)
+		return "", err
+	}
+	log.Printf("history of room %s is compacted: %d bytes to %d bytes\n",
+		m.Options.Name, before, m.radio.FileSize())
+	m.archiveSignChanged()
+	m.broadcastCommand(CompactAction{
+		Action:    "compact",
+		Signature: signature,
+	})
+	return signature, nil
+}
+
+// rollback drops history recorded after at, and tells everyone to download
+// archive again.
+func (m *Room) rollback(at time.Time) (string, error) {
+	var before = m.radio.FileSize()
+	signature, err := m.radio.Rollback(at)
+	if err != nil {
+		if err != Radio.ErrRebuilding {
+			log.Println("cannot roll back history of room", m.Options.Name, err)
+		}
+		return "", err
+	}
+	log.Printf("history of room %s is rolled back to %v: %d bytes to %d bytes\n",
+		m.Options.Name, at, before, m.radio.FileSize())
+	m.archiveSignChanged()
+	m.broadcastCommand(RollbackAction{
+		Action:    "rollback",
+		Timestamp: at.Unix(),
+		Signature: signature,
+	})
+	return signature, nil
+}
+
+// purgeUser removes everything drawn by user of clientId, or of name, from
+// history, and tells everyone to download archive again. Either of them is
+// found from the other one if the user is online.
+func (m *Room) purgeUser(clientId, name string) (string, error) {
+	if user := m.findUser(clientId, name); user != nil {
+		clientId, name = user.clientId, user.nickName
+	}
+	signature, err := m.radio.Purge(clientId, func(entry History.Entry, frame []byte) bool {
+		action, err := Canvas.DecodeFrame(frame)
+		if err != nil {
+			return false
+		}
+		return (len(clientId) > 0 && action.UserId == clientId) ||
+			(len(name) > 0 && action.Name == name)
+	})
+	if err != nil {
+		if err != Radio.ErrRebuilding {
+			log.Println("cannot purge user of room", m.Options.Name, err)
+		}
+		return "", err
+	}
+	log.Printf("strokes of %s(%s) are purged from room %s\n", name, clientId, m.Options.Name)
+	m.archiveSignChanged()
+	m.broadcastCommand(PurgeUserAction{
+		Action:    "purgeuser",
+		ClientId:  clientId,
+		Name:      name,
+		Signature: signature,
+	})
+	return signature, nil
+}
+
+// clearLayer removes packs of layer from history, and tells everyone to
+// drop the layer.
+func (m *Room) clearLayer(layer string) (string, error) {
+	signature, err := m.radio.Rewrite(func(entry History.Entry, frame []byte) bool {
+		action, err := Canvas.DecodeFrame(frame)
+		return err != nil || action.Layer != layer
+	})
+	if err != nil {
+		if err != Radio.ErrRebuilding {
+			log.Println("cannot clear layer of room", m.Options.Name, err)
+		}
+		return "", err
+	}
+	m.archiveSignChanged()
+	// after data queued before
+	m.queueRewriteCommand(func(offset int64) interface{} {
+		return ClearLayerAction{
+			Action:    "clearlayer",
+			Layer:     layer,
+			Signature: signature,
+			Offset:    offset,
+		}
+	})
+	return signature, nil
+}
+
 func ServeRoom(opt RoomOption) (*Room, error) {
 	var room = Room{
 		Options:    opt,
@@ -315,6 +671,8 @@ func ServeRoom(opt RoomOption) (*Room, error) {
 func RecoverRoom(info *RoomRuntimeInfo) (r *Room, err error) {
 	var room = Room{
 		port:        info.Port,
+		wsPort:      info.WebSocketPort,
+		tlsPort:     info.TLSPort,
 		expiration:  info.Expiration,
 		archiveSign: info.ArchiveSign,
 		key:         info.Key,
@@ -324,6 +682,11 @@ func RecoverRoom(info *RoomRuntimeInfo) (r *Room, err error) {
 	if err := room.init(); err != nil {
 		return &Room{}, err
 	}
+	if err := room.repairHistory(); err != nil {
+		room.radio.Close()
+		room.closeListeners()
+		return &Room{}, err
+	}
 
 	defer func() {
 		if err := recover(); err != nil {
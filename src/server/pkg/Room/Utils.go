@@ -5,23 +5,30 @@ import (
 	"bytes"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	xxhash "github.com/cespare/xxhash"
 	"github.com/dustin/randbo"
 	"io"
 	"log"
+	"os"
+	"path/filepath"
+	"server/pkg/Canvas"
 	"server/pkg/Config"
 	"server/pkg/Socket"
 	"strconv"
+	"sync/atomic"
 	"time"
 )
 
 type RoomRuntimeInfo struct {
-	Key         string     `json: "key"`
-	ArchiveSign string     `json: "archiveSign"`
-	Port        uint16     `json: "port"`
-	Expiration  int        `json: "expiration"`
-	Options     RoomOption `json: "options"`
+	Key           string     `json:"key"`
+	ArchiveSign   string     `json:"archiveSign"`
+	Port          uint16     `json:"port"`
+	WebSocketPort uint16     `json:"wsport"`
+	TLSPort       uint16     `json:"tlsport"`
+	Expiration    int        `json:"expiration"`
+	Options       RoomOption `json:"options"`
 }
 
 func (r *RoomRuntimeInfo) ToJson() ([]byte, error) {
@@ -31,11 +38,13 @@ func (r *RoomRuntimeInfo) ToJson() ([]byte, error) {
 func dumpRoom(room *Room) []byte {
 
 	info := RoomRuntimeInfo{
-		Key:         room.key,
-		ArchiveSign: room.archiveSign,
-		Expiration:  room.expiration,
-		Port:        room.port,
-		Options:     room.Options,
+		Key:           room.key,
+		ArchiveSign:   room.radio.Signature(),
+		Expiration:    room.expiration,
+		Port:          room.port,
+		WebSocketPort: room.wsPort,
+		TLSPort:       room.tlsPort,
+		Options:       room.Options,
 	}
 
 	raw, err := info.ToJson()
@@ -66,6 +75,24 @@ func (m *Room) findClientById(clientId string) *Socket.SocketClient {
 	return result
 }
 
+// findUser finds online user by clientId, or by name if clientId is empty.
+func (m *Room) findUser(clientId, name string) *RoomUser {
+	var result *RoomUser
+	m.clients.Range(func(key, value interface{}) bool {
+		user, ok := value.(*RoomUser)
+		if !ok || len(user.clientId) <= 0 {
+			return true
+		}
+		if (len(clientId) > 0 && user.clientId == clientId) ||
+			(len(clientId) <= 0 && user.nickName == name) {
+			result = user
+			return false
+		}
+		return true
+	})
+	return result
+}
+
 func (m *Room) broadcastCommand(resp interface{}) {
 	data, err := json.Marshal(resp)
 	if err != nil {
@@ -91,6 +118,58 @@ func (m *Room) broadcastCommand(resp interface{}) {
 	})
 }
 
+// restamp overwrites who sends a DATA or MESSAGE pack with user, since
+// clients can claim anyone, and packs it again. Other fields are kept as is.
+func restamp(pkg Socket.Package, user *RoomUser) ([]byte, error) {
+	var fields = make(map[string]json.RawMessage)
+	if err := json.Unmarshal(pkg.Unpacked, &fields); err != nil {
+		return nil, err
+	}
+	userId, _ := json.Marshal(user.clientId)
+	name, _ := json.Marshal(user.nickName)
+	fields["userid"] = userId
+	if pkg.PackageType == Socket.MESSAGE {
+		fields["from"] = name
+	} else {
+		fields["name"] = name
+	}
+	// content may be html, keep it as is
+	var raw bytes.Buffer
+	var encoder = json.NewEncoder(&raw)
+	encoder.SetEscapeHTML(false)
+	if err := encoder.Encode(fields); err != nil {
+		return nil, err
+	}
+	return Socket.AssamblePack(Socket.PackHeader{
+		Compress: true,
+		PackType: pkg.PackageType,
+		Codec:    Socket.CODEC_ZLIB,
+	}, bytes.TrimSpace(raw.Bytes())), nil
+}
+
+// recipientOf tells clientid in "to" of a MESSAGE pack. It's empty for
+// public chat.
+func recipientOf(pkg Socket.Package) string {
+	var message struct {
+		To string `json:"to"`
+	}
+	json.Unmarshal(pkg.Unpacked, &message)
+	return message.To
+}
+
+// queueRewriteCommand sends an action to everyone after data queued before.
+// History is rewritten just now, and offset in the action tells a client
+// how much of the new history it has got by then.
+func (m *Room) queueRewriteCommand(build func(offset int64) interface{}) {
+	m.radio.SendAtEnd(func(client *Socket.SocketClient, offset int64) []byte {
+		raw, err := json.Marshal(build(offset))
+		if err != nil {
+			panic(err)
+		}
+		return Socket.AssamblePack(client.HeaderFor(Socket.COMMAND, len(raw)), raw)
+	})
+}
+
 func (m *Room) sendAnnouncement(client *Socket.SocketClient) {
 	msg := Config.ReadConfString("announcement", "")
 	if len(msg) <= 0 {
@@ -127,6 +206,159 @@ func (m *Room) sendExpirationMsg(client *Socket.SocketClient) {
 	directSendMessage(resp, client)
 }
 
+var errExporting = errors.New("canvas is being exported")
+
+// exportName is where history of current signature and size is exported
+// to, so that history already exported is not rendered again.
+func (m *Room) exportName(format string) string {
+	var base = fmt.Sprintf("%s-%d.%s", m.radio.Signature(), m.radio.FileSize(), format)
+	return filepath.Join(m.exportDir(), base)
+}
+
+// exportDir keeps exports of this room only, so that nobody can read
+// exports of other rooms by path. It's named after name and key of room,
+// which never change, and differ from a room of the same name before.
+func (m *Room) exportDir() string {
+	data_dir := Config.ReadConfString("data_dir", "./data/")
+	var hash = xxhash.Sum64String(m.Options.Name + m.key)
+	return filepath.Join(data_dir, EXPORT_DIR, strconv.FormatUint(hash, 32))
+}
+
+// exportHistory renders history into file name, unless it's there already.
+// Only one export is rendered at a time for a room.
+func (m *Room) exportHistory(name, format string) error {
+	if _, err := os.Stat(name); err == nil {
+		// kept as long as it's asked for
+		var now = time.Now()
+		os.Chtimes(name, now, now)
+		m.exports.Store(format, name)
+		return nil
+	}
+	if !atomic.CompareAndSwapInt32(&m.exporting, 0, 1) {
+		return errExporting
+	}
+	defer atomic.StoreInt32(&m.exporting, 0)
+	canvas, err := m.radio.Render(int(m.Options.Width), int(m.Options.Height))
+	if err != nil {
+		return err
+	}
+	if err := writeExport(canvas, name, format); err != nil {
+		return err
+	}
+	m.exports.Store(format, name)
+	return nil
+}
+
+// exportAll renders history into every format not exported yet, if anything
+// is drawn. It waits for timeout at most; the render left behind fails once
+// history is removed.
+func (m *Room) exportAll(timeout time.Duration) {
+	if m.radio.FileSize() == 0 {
+		return
+	}
+	var names = make(map[string]string)
+	for _, format := range []string{Canvas.FORMAT_PNG, Canvas.FORMAT_ORA} {
+		var name = m.exportName(format)
+		if _, err := os.Stat(name); err != nil {
+			names[format] = name
+		}
+	}
+	if len(names) == 0 {
+		return
+	}
+	var done = make(chan bool)
+	go func() {
+		defer close(done)
+		canvas, err := m.radio.Render(int(m.Options.Width), int(m.Options.Height))
+		if err != nil {
+			log.Println("cannot export room", m.Options.Name, err)
+			return
+		}
+		for format, name := range names {
+			if err := writeExport(canvas, name, format); err != nil {
+				log.Println("cannot export room", m.Options.Name, err)
+			}
+		}
+	}()
+	select {
+	case <-done:
+	case <-time.After(timeout):
+		log.Println("export of room", m.Options.Name, "is given up after", timeout)
+	}
+}
+
+// RemoveExpiredExports removes exported files not asked for within
+// retention, and directories of rooms left empty. Nothing is removed if
+// retention is 0 or less.
+func RemoveExpiredExports(retention time.Duration) {
+	if retention <= 0 {
+		return
+	}
+	data_dir := Config.ReadConfString("data_dir", "./data/")
+	removeExpiredExports(filepath.Join(data_dir, EXPORT_DIR), time.Now().Add(-retention))
+}
+
+func removeExpiredExports(root string, deadline time.Time) {
+	filepath.Walk(root, func(name string, info os.FileInfo, err error) error {
+		if err != nil || !info.ModTime().Before(deadline) {
+			return nil
+		}
+		if !info.IsDir() {
+			os.Remove(name)
+		} else if name != root && os.Remove(name) == nil {
+			// it's empty since then
+			return filepath.SkipDir
+		}
+		return nil
+	})
+}
+
+// writeExport writes canvas into file name, which is replaced once done.
+func writeExport(canvas *Canvas.Canvas, name, format string) error {
+	if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+		return err
+	}
+	file, err := os.Create(name + ".tmp")
+	if err != nil {
+		return err
+	}
+	err = canvas.Export(format, file)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(name + ".tmp")
+		return err
+	}
+	return os.Rename(name+".tmp", name)
+}
+
+// readExport reads a piece of exported file from offset, and tells size of
+// the whole file.
+func readExport(name string, offset int64) ([]byte, int64, error) {
+	file, err := os.Open(name)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return nil, 0, err
+	}
+	if offset < 0 || offset > info.Size() {
+		return nil, 0, io.EOF
+	}
+	var length = info.Size() - offset
+	if length > EXPORT_PIECE_SIZE {
+		length = EXPORT_PIECE_SIZE
+	}
+	var piece = make([]byte, length)
+	if _, err := file.ReadAt(piece, offset); err != nil {
+		return nil, 0, err
+	}
+	return piece, info.Size(), nil
+}
+
 func genSignedKey(source []byte) string {
 	h := xxhash.New()
 	r := bytes.NewReader(append(source, Config.ReadConfBytes("globalSaltHash")...))
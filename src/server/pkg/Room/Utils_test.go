@@ -0,0 +1,223 @@
+package Room
+
+import "testing"
+
+import "encoding/json"
+import "io/ioutil"
+import "net"
+import "os"
+import "path/filepath"
+import "strings"
+import "time"
+import "server/pkg/Radio"
+import "server/pkg/Socket"
+
+func decodePack(t *testing.T, frame []byte) (Socket.Package, map[string]string) {
+	pkg, err := Socket.DecodeFrame(frame)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var fields = make(map[string]string)
+	if err := json.Unmarshal(pkg.Unpacked, &fields); err != nil {
+		t.Fatal(err)
+	}
+	return pkg, fields
+}
+
+func TestRestamp(t *testing.T) {
+	var user = &RoomUser{clientId: "46b67a67", nickName: "alice"}
+
+	var message = Socket.Package{
+		PackageType: Socket.MESSAGE,
+		Unpacked:    []byte(`{"from":"bob","userid":"fake","to":"","content":"<b>hi</b>"}`),
+	}
+	raw, err := restamp(message, user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pkg, fields := decodePack(t, raw)
+	if pkg.PackageType != Socket.MESSAGE {
+		t.Error("pack type should be kept", pkg.PackageType)
+	}
+	if fields["from"] != "alice" || fields["userid"] != "46b67a67" {
+		t.Error("sender should be overwritten", fields)
+	}
+	if fields["content"] != "<b>hi</b>" || string(pkg.Unpacked) != `{"content":"<b>hi</b>","from":"alice","to":"","userid":"46b67a67"}` {
+		t.Error("others should be kept as is", string(pkg.Unpacked))
+	}
+
+	var data = Socket.Package{
+		PackageType: Socket.DATA,
+		Unpacked:    []byte(`{"action":"drawpoint","name":"bob","point":{"x":1,"y":2}}`),
+	}
+	raw, err = restamp(data, user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pkg, err = Socket.DecodeFrame(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var action struct {
+		Name   string          `json:"name"`
+		UserId string          `json:"userid"`
+		Point  json.RawMessage `json:"point"`
+	}
+	json.Unmarshal(pkg.Unpacked, &action)
+	if pkg.PackageType != Socket.DATA || action.Name != "alice" || action.UserId != "46b67a67" {
+		t.Error("painter should be overwritten", string(pkg.Unpacked))
+	}
+	if string(action.Point) != `{"x":1,"y":2}` {
+		t.Error("point should be kept", string(action.Point))
+	}
+
+	if _, err := restamp(Socket.Package{PackageType: Socket.MESSAGE, Unpacked: []byte(`[]`)}, user); err == nil {
+		t.Error("pack other than an object should be refused")
+	}
+}
+
+func TestSendPrivateMessage(t *testing.T) {
+	dir, err := ioutil.TempDir("", "room")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	radio, err := Radio.MakeRadio(dir, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer radio.Remove()
+	defer radio.Close()
+	var m = &Room{radio: radio}
+
+	var join = func(clientId string, online bool) (*Socket.SocketClient, *Socket.SocketReader, func()) {
+		serverConn, clientConn := net.Pipe()
+		var client = Socket.MakeSocketClient(serverConn)
+		m.clients.Store(client, &RoomUser{clientId: clientId, nickName: clientId})
+		if online {
+			radio.AddClient(client, 0, 0)
+		}
+		clientConn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		return client, Socket.NewSocketReader(clientConn), func() {
+			client.Close()
+			clientConn.Close()
+		}
+	}
+	alice, aliceReader, closeAlice := join("alice", true)
+	defer closeAlice()
+	_, bobReader, closeBob := join("bob", true)
+	defer closeBob()
+	_, _, closeCarol := join("carol", false)
+	defer closeCarol()
+
+	var message = Socket.AssamblePack(Socket.PackHeader{PackType: Socket.MESSAGE},
+		[]byte(`{"from":"alice","to":"bob","content":"hi"}`))
+	m.sendPrivateMessage(message, alice, "bob")
+	for name, reader := range map[string]*Socket.SocketReader{"alice": aliceReader, "bob": bobReader} {
+		frame, err := reader.ReadFrame()
+		if err != nil {
+			t.Fatal(name, "should receive the message", err)
+		}
+		if _, fields := decodePack(t, frame); fields["content"] != "hi" {
+			t.Error(name, "received wrong message", fields)
+		}
+	}
+
+	// dave is unknown, and carol hasn't asked for archive
+	for _, to := range []string{"dave", "carol"} {
+		m.sendPrivateMessage(message, alice, to)
+		frame, err := aliceReader.ReadFrame()
+		if err != nil {
+			t.Fatal("sender should be told", err)
+		}
+		pkg, fields := decodePack(t, frame)
+		if pkg.PackageType != Socket.COMMAND || fields["action"] != "undelivered" || fields["to"] != to {
+			t.Error("sender should be told the message is undelivered", string(pkg.Unpacked))
+		}
+	}
+}
+
+func TestTasksAfterClose(t *testing.T) {
+	dir, err := ioutil.TempDir("", "room")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	radio, err := Radio.MakeRadio(dir, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer radio.Remove()
+	var m = &Room{radio: radio, GoingClose: make(chan bool)}
+	serverConn, clientConn := net.Pipe()
+	defer clientConn.Close()
+	var client = Socket.MakeSocketClient(serverConn)
+	defer client.Close()
+
+	var done = make(chan bool)
+	m.runTask(func() {
+		<-done
+		// room is closed meanwhile
+		m.sendCommandTo(UndeliveredAction{Action: "undelivered"}, client)
+	})
+	m.tasksLocker.Lock()
+	close(m.GoingClose)
+	m.tasksLocker.Unlock()
+	radio.Close()
+	close(done)
+	m.tasks.Wait()
+
+	var ran bool
+	m.runTask(func() {
+		ran = true
+	})
+	m.tasks.Wait()
+	if ran {
+		t.Error("task should not run once room is closing")
+	}
+}
+
+func TestExportDir(t *testing.T) {
+	var first = &Room{Options: RoomOption{Name: "black hole"}, key: "first"}
+	var second = &Room{Options: RoomOption{Name: "black hole"}, key: "second"}
+	if first.exportDir() == second.exportDir() {
+		t.Error("rooms should not share exports", first.exportDir())
+	}
+	if filepath.Dir(first.exportDir()) != filepath.Dir(second.exportDir()) {
+		t.Error("exports should be kept in one place", first.exportDir(), second.exportDir())
+	}
+}
+
+func TestRemoveExpiredExports(t *testing.T) {
+	root, err := ioutil.TempDir("", "exports")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	var old = time.Now().Add(-2 * time.Hour)
+	for _, name := range []string{"a/old.png", "a/new.png", "b/old.ora", "c/"} {
+		var path = filepath.Join(root, name)
+		os.MkdirAll(filepath.Dir(path), 0755)
+		if !strings.HasSuffix(name, "/") {
+			ioutil.WriteFile(path, []byte("exported"), 0644)
+		}
+	}
+	for _, name := range []string{"a/old.png", "b/old.ora", "c"} {
+		os.Chtimes(filepath.Join(root, name), old, old)
+	}
+
+	removeExpiredExports(root, time.Now().Add(-time.Hour))
+	for name, kept := range map[string]bool{"a/new.png": true, "a/old.png": false, "b/old.ora": false, "c": false} {
+		if _, err := os.Stat(filepath.Join(root, name)); (err == nil) != kept {
+			t.Error(name, "should be kept:", kept)
+		}
+	}
+	// b is emptied just now, and removed later
+	if _, err := os.Stat(filepath.Join(root, "b")); err != nil {
+		t.Error("b should be kept for now", err)
+	}
+	removeExpiredExports(root, time.Now().Add(time.Hour))
+	if _, err := os.Stat(filepath.Join(root, "b")); err == nil {
+		t.Error("b should be removed")
+	}
+}
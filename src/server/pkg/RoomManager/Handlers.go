@@ -5,8 +5,22 @@ import "sync/atomic"
 import "encoding/json"
 import "server/pkg/Socket"
 import "server/pkg/Room"
+import "server/pkg/ErrorCode"
 import "github.com/syndtr/goleveldb/leveldb/opt"
 
+func (m *RoomManager) handleHello(data []byte, client *Socket.SocketClient) {
+	req := &Socket.HelloRequest{}
+	json.Unmarshal(data, &req)
+	var raw, err = json.Marshal(client.AnswerHello(req))
+	if err != nil {
+		log.Panicln(err)
+	}
+	_, err = client.SendManagerPack(raw)
+	if err != nil {
+		client.Close()
+	}
+}
+
 func (m *RoomManager) handleRoomList(data []byte, client *Socket.SocketClient) {
 	req := &RoomListRequest{}
 	json.Unmarshal(data, &req)
@@ -22,7 +36,9 @@ func (m *RoomManager) handleRoomList(data []byte, client *Socket.SocketClient) {
 			Private:       len(roomInstance.Options.Password) > 0,
 			MaxLoad:       roomInstance.Options.MaxLoad,
 			ServerAddress: "0.0.0.0",
-			Port:          roomInstance.Port(),
+			Port:          m.publicPort(roomInstance, client),
+			WebSocketPort: roomInstance.WebSocketPort(),
+			TLSPort:       roomInstance.TLSPort(),
 		}
 		roomlist = append(roomlist, room)
 		return true
@@ -82,6 +98,7 @@ func (m *RoomManager) handleNewRoom(data []byte, client *Socket.SocketClient) {
 	if err != nil {
 		panic(err)
 	}
+	room.OnArchiveSignChanged(m.saveArchiveSign)
 	m.rooms.Store(room.Options.Name, room)
 	atomic.AddInt32(&m.currentRoomCount, -1)
 	go func(room *Room.Room, m *RoomManager) {
@@ -99,9 +116,11 @@ func (m *RoomManager) handleNewRoom(data []byte, client *Socket.SocketClient) {
 		Response: "newroom",
 		Result:   true,
 		Info: NewRoomInfoForReply{
-			Port:     room.Port(),
-			Key:      room.Key(),
-			Password: room.Password(),
+			Port:          m.publicPort(room, client),
+			WebSocketPort: room.WebSocketPort(),
+			TLSPort:       room.TLSPort(),
+			Key:           room.Key(),
+			Password:      room.Password(),
 		},
 		ErrCode: 0,
 	}
@@ -114,3 +133,52 @@ func (m *RoomManager) handleNewRoom(data []byte, client *Socket.SocketClient) {
 		panic(err)
 	}
 }
+
+// handleRoomHello answers hello on shared room port, just like rooms do.
+// It returns false if pkg is not a hello request.
+func (m *RoomManager) handleRoomHello(pkg Socket.Package, client *Socket.SocketClient) bool {
+	if pkg.PackageType != Socket.COMMAND {
+		return false
+	}
+	req := &Socket.HelloRequest{}
+	if json.Unmarshal(pkg.Unpacked, &req) != nil || req.Request != "hello" {
+		return false
+	}
+	var raw, err = json.Marshal(client.AnswerHello(req))
+	if err != nil {
+		panic(err)
+	}
+	_, err = client.SendCommandPack(raw)
+	if err != nil {
+		client.Close()
+	}
+	return true
+}
+
+func (m *RoomManager) handleRoomLogin(pkg Socket.Package, client *Socket.SocketClient) {
+	req := &Room.JoinRoomRequest{}
+	if pkg.PackageType == Socket.COMMAND {
+		json.Unmarshal(pkg.Unpacked, &req)
+	}
+
+	if req.Request == "login" {
+		if value, ok := m.rooms.Load(req.Room); ok {
+			if roomInstance, ok := value.(*Room.Room); ok {
+				roomInstance.Attach(client, pkg)
+				return
+			}
+		}
+	}
+
+	var resp = Room.JoinRoomResponse{
+		Response: "login",
+		Result:   false,
+		ErrCode:  ErrorCode.LOGIN_ROOM_NOT_FOUND,
+	}
+	raw, err := json.Marshal(resp)
+	if err != nil {
+		panic(err)
+	}
+	client.SendCommandPack(raw)
+	client.Close()
+}
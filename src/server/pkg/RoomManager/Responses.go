@@ -9,6 +9,8 @@ type RoomPublicInfo struct {
 	Private       bool   `json:"private"`
 	ServerAddress string `json:"serveraddress"`
 	Port          uint16 `json:"port"`
+	WebSocketPort uint16 `json:"wsport"`
+	TLSPort       uint16 `json:"tlsport"`
 }
 
 type RoomListResponse struct {
@@ -19,9 +21,11 @@ type RoomListResponse struct {
 }
 
 type NewRoomInfoForReply struct {
-	Port     uint16 `json:"port"`
-	Key      string `json:"key"`
-	Password string `json:"password"`
+	Port          uint16 `json:"port"`
+	WebSocketPort uint16 `json:"wsport"`
+	TLSPort       uint16 `json:"tlsport"`
+	Key           string `json:"key"`
+	Password      string `json:"password"`
 }
 
 type NewRoomResponse struct {
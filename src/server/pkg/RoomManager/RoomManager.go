@@ -1,6 +1,7 @@
 package RoomManager
 
 import (
+	"expvar"
 	"github.com/syndtr/goleveldb/leveldb"
 	"github.com/syndtr/goleveldb/leveldb/opt"
 	dbutil "github.com/syndtr/goleveldb/leveldb/util"
@@ -17,17 +18,23 @@ import (
 )
 
 type RoomManager struct {
-	ln               *net.TCPListener
+	ln               net.Listener
+	wsLn             net.Listener
+	tlsLn            net.Listener
+	roomLn           net.Listener
+	roomPort         uint16
 	goingClose       chan bool
 	router           *Router.Router
 	rooms            sync.Map
 	currentRoomCount int32
 	db               *leveldb.DB
+	dbLocker         sync.Mutex // guards read-modify-write of room info
 }
 
 func (m *RoomManager) init() error {
 	m.goingClose = make(chan bool)
 	m.router = Router.MakeRouter("request")
+	m.router.Register("hello", m.handleHello)
 	m.router.Register("roomlist", m.handleRoomList)
 	m.router.Register("newroom", m.handleNewRoom)
 
@@ -63,6 +70,41 @@ func (m *RoomManager) init() error {
 
 	log.Println("RoomManager is listening on port", ideal_port)
 
+	if wsPort := Config.ReadConfInt("websocket_port", 0); wsPort > 0 {
+		m.wsLn, _, err = Socket.ListenWebSocket(uint16(wsPort))
+		if err != nil {
+			log.Println("RoomManager cannot listen on websocket port", wsPort)
+			return err
+		}
+		log.Println("RoomManager is listening on websocket port", wsPort)
+	}
+
+	tlsConfig, err := Socket.LoadTLSConfig(
+		Config.ReadConfString("tls_cert", ""),
+		Config.ReadConfString("tls_key", ""))
+	if err != nil {
+		log.Println("RoomManager cannot load TLS certificate")
+		return err
+	}
+	if tlsConfig != nil {
+		tlsPort := Config.ReadConfInt("tls_port", ideal_port+1)
+		m.tlsLn, _, err = Socket.ListenTLS(uint16(tlsPort), tlsConfig)
+		if err != nil {
+			log.Println("RoomManager cannot listen on TLS port", tlsPort)
+			return err
+		}
+		log.Println("RoomManager is listening on TLS port", tlsPort)
+	}
+
+	if roomPort := Config.ReadConfInt("room_port", 0); roomPort > 0 {
+		m.roomLn, m.roomPort, err = Socket.ListenTCP(uint16(roomPort))
+		if err != nil {
+			log.Println("RoomManager cannot listen on shared room port", roomPort)
+			return err
+		}
+		log.Println("RoomManager is listening on shared room port", roomPort)
+	}
+
 	m.recovery()
 	go m.shortenRooms()
 
@@ -89,6 +131,7 @@ func (m *RoomManager) recovery() error {
 			continue
 		}
 
+		room.OnArchiveSignChanged(m.saveArchiveSign)
 		m.rooms.Store(room.Options.Name, room)
 		atomic.AddInt32(&m.currentRoomCount, -1)
 		go func(room *Room.Room, m *RoomManager) {
@@ -107,6 +150,7 @@ func (m *RoomManager) shortenRooms() {
 	for {
 		select {
 		case <-time.After(time.Hour):
+			m.dbLocker.Lock()
 			iter := m.db.NewIterator(dbutil.BytesPrefix([]byte("room-")), nil)
 
 			batch := new(leveldb.Batch)
@@ -131,12 +175,54 @@ func (m *RoomManager) shortenRooms() {
 			}
 			iter.Release()
 			m.db.Write(batch, nil)
+			m.dbLocker.Unlock()
+			Room.RemoveExpiredExports(time.Duration(Config.ReadConfInt("export_retention",
+				Room.DEFAULT_EXPORT_RETENTION)) * time.Hour)
 		case _, _ = <-m.goingClose:
 			return
 		}
 	}
 }
 
+// saveArchiveSign keeps signature of room in db, so that room recovers with
+// the right history. Others in db, like expiration, stay as is.
+func (m *RoomManager) saveArchiveSign(room *Room.Room) {
+	m.dbLocker.Lock()
+	defer m.dbLocker.Unlock()
+	var key = []byte("room-" + room.Options.Name)
+	value, err := m.db.Get(key, nil)
+	if err != nil {
+		log.Println("cannot save signature of room", room.Options.Name, err)
+		return
+	}
+	info := parseRoomRuntimeInfo(value)
+	info.ArchiveSign = room.ArchiveSign()
+	info_to_insert, err := info.ToJson()
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	m.db.Put(key, info_to_insert, &opt.WriteOptions{})
+}
+
+// LoadRooms reads records of rooms in db at dbDir, by archive signature.
+// It's for tools working on data of a stopped server.
+func LoadRooms(dbDir string) (map[string]*Room.RoomRuntimeInfo, error) {
+	db, err := leveldb.OpenFile(dbDir, &opt.Options{ReadOnly: true, ErrorIfMissing: true})
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+	var rooms = make(map[string]*Room.RoomRuntimeInfo)
+	iter := db.NewIterator(dbutil.BytesPrefix([]byte("room-")), nil)
+	for iter.Next() {
+		info := parseRoomRuntimeInfo(iter.Value())
+		rooms[info.ArchiveSign] = info
+	}
+	iter.Release()
+	return rooms, iter.Error()
+}
+
 func (m *RoomManager) waitRoomClosed(roomName string) {
 	m.db.Delete([]byte("room-"+roomName), &opt.WriteOptions{})
 	m.rooms.Delete(roomName)
@@ -147,6 +233,15 @@ func (m *RoomManager) Close() {
 	close(m.goingClose)
 	m.db.Close()
 	m.ln.Close()
+	if m.wsLn != nil {
+		m.wsLn.Close()
+	}
+	if m.tlsLn != nil {
+		m.tlsLn.Close()
+	}
+	if m.roomLn != nil {
+		m.roomLn.Close()
+	}
 }
 
 func (m *RoomManager) Run() (err error) {
@@ -154,18 +249,32 @@ func (m *RoomManager) Run() (err error) {
 	if err != nil {
 		return err
 	}
+	if m.wsLn != nil {
+		go m.serve(m.wsLn, m.processClient)
+	}
+	if m.tlsLn != nil {
+		go m.serve(m.tlsLn, m.processClient)
+	}
+	if m.roomLn != nil {
+		go m.serve(m.roomLn, m.processRoomClient)
+	}
+	m.serve(m.ln, m.processClient)
+	return err
+}
+
+func (m *RoomManager) serve(ln net.Listener, handler func(*Socket.SocketClient)) {
 	for {
 		select {
 		case _, _ = <-m.goingClose:
-			return err
+			return
 		default:
-			conn, err := m.ln.AcceptTCP()
+			conn, err := ln.Accept()
 			if err != nil {
 				// handle error
 				log.Println(err)
 				continue
 			}
-			go m.processClient(Socket.MakeSocketClient(conn))
+			go handler(Socket.MakeSocketClient(conn))
 		}
 	}
 }
@@ -190,6 +299,72 @@ func (m *RoomManager) processClient(client *Socket.SocketClient) {
 	}
 }
 
+// processRoomClient serves clients come from shared room port. The first
+// package must be a login request which names the room, optionally after
+// hello, and client is handed over to that room afterwards.
+func (m *RoomManager) processRoomClient(client *Socket.SocketClient) {
+	for {
+		select {
+		case _, _ = <-m.goingClose:
+			client.Close()
+			return
+		case pkg, ok := <-client.GetPackageChan():
+			if !ok {
+				return
+			}
+			if m.handleRoomHello(pkg, client) {
+				continue
+			}
+			m.handleRoomLogin(pkg, client)
+			return
+		case <-time.After(time.Second * 30):
+			client.Close()
+			return
+		}
+	}
+}
+
+// CAPABILITY_SHARED_PORT tells that client logins on the shared room port
+// with a room name. Others are sent to ports of rooms.
+const CAPABILITY_SHARED_PORT = "sharedport"
+
+func init() {
+	Socket.RegisterCapability(CAPABILITY_SHARED_PORT)
+	expvar.Publish("rooms", expvar.Func(func() interface{} {
+		manager, ok := statsManager.Load().(*RoomManager)
+		if !ok {
+			return nil
+		}
+		return manager.roomStats()
+	}))
+}
+
+// publicPort is the port client should connect to for room.
+func (m *RoomManager) publicPort(room *Room.Room, client *Socket.SocketClient) uint16 {
+	if m.roomPort > 0 && client.HasCapability(CAPABILITY_SHARED_PORT) {
+		return m.roomPort
+	}
+	return room.Port()
+}
+
+// roomStats is published as "rooms" in /debug/vars.
+func (m *RoomManager) roomStats() interface{} {
+	var stats = make(map[string]Room.RoomStats)
+	m.rooms.Range(func(key, value interface{}) bool {
+		room, ok := value.(*Room.Room)
+		if ok {
+			stats[room.Options.Name] = room.Stats()
+		}
+		return true
+	})
+	return stats
+}
+
+// statsManager is the latest manager served, whose rooms are in "rooms".
+var statsManager atomic.Value
+
 func ServeManager() *RoomManager {
-	return &RoomManager{}
+	var manager = &RoomManager{}
+	statsManager.Store(manager)
+	return manager
 }
@@ -0,0 +1,111 @@
+package Socket
+
+import (
+	"sort"
+	"sync"
+)
+
+// PROTOCOL_VERSION is sent to clients in hello response. Clients never say
+// hello are treated as version 0, and get nothing beyond the legacy protocol.
+const PROTOCOL_VERSION = 1
+
+var capabilities = struct {
+	table  map[string]bool
+	locker sync.RWMutex
+}{table: make(map[string]bool)}
+
+// RegisterCapability announces a feature that can be turned on per
+// connection via hello.
+func RegisterCapability(name string) {
+	capabilities.locker.Lock()
+	defer capabilities.locker.Unlock()
+	capabilities.table[name] = true
+}
+
+func ServerCapabilities() []string {
+	capabilities.locker.RLock()
+	defer capabilities.locker.RUnlock()
+	var list = make([]string, 0, len(capabilities.table))
+	for name := range capabilities.table {
+		list = append(list, name)
+	}
+	sort.Strings(list)
+	return list
+}
+
+func isServerCapability(name string) bool {
+	capabilities.locker.RLock()
+	defer capabilities.locker.RUnlock()
+	return capabilities.table[name]
+}
+
+// HelloRequest is the same for RoomManager and rooms.
+type HelloRequest struct {
+	Request       string   `json:"request"`
+	Version       int      `json:"version"`
+	ClientVersion string   `json:"clientversion"`
+	Capabilities  []string `json:"capabilities"`
+}
+
+type HelloResponse struct {
+	Response     string   `json:"response"`
+	Result       bool     `json:"result"`
+	Version      int      `json:"version"`
+	Capabilities []string `json:"capabilities"`
+}
+
+type helloInfo struct {
+	protocolVersion int
+	clientVersion   string
+	capabilities    map[string]bool
+	locker          sync.RWMutex
+}
+
+// Hello records what client told us, and returns capabilities both sides
+// support, which are the ones enabled on this connection.
+func (c *SocketClient) Hello(version int, clientVersion string, caps []string) []string {
+	var enabled = make(map[string]bool)
+	var list = make([]string, 0)
+	for _, name := range caps {
+		if isServerCapability(name) && !enabled[name] {
+			enabled[name] = true
+			list = append(list, name)
+		}
+	}
+	sort.Strings(list)
+
+	c.hello.locker.Lock()
+	defer c.hello.locker.Unlock()
+	c.hello.protocolVersion = version
+	c.hello.clientVersion = clientVersion
+	c.hello.capabilities = enabled
+	return list
+}
+
+// AnswerHello records req as Hello does, and makes the response to it.
+func (c *SocketClient) AnswerHello(req *HelloRequest) HelloResponse {
+	return HelloResponse{
+		Response:     "hello",
+		Result:       true,
+		Version:      PROTOCOL_VERSION,
+		Capabilities: c.Hello(req.Version, req.ClientVersion, req.Capabilities),
+	}
+}
+
+func (c *SocketClient) ProtocolVersion() int {
+	c.hello.locker.RLock()
+	defer c.hello.locker.RUnlock()
+	return c.hello.protocolVersion
+}
+
+func (c *SocketClient) ClientVersion() string {
+	c.hello.locker.RLock()
+	defer c.hello.locker.RUnlock()
+	return c.hello.clientVersion
+}
+
+func (c *SocketClient) HasCapability(name string) bool {
+	c.hello.locker.RLock()
+	defer c.hello.locker.RUnlock()
+	return c.hello.capabilities[name]
+}
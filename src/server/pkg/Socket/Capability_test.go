@@ -0,0 +1,24 @@
+package Socket
+
+import "testing"
+
+func TestHello(t *testing.T) {
+	RegisterCapability("test:foo")
+	RegisterCapability("test:bar")
+
+	var client = SocketClient{}
+	if client.ProtocolVersion() != 0 || client.HasCapability("test:foo") {
+		t.Error("client without hello should be legacy")
+	}
+
+	var enabled = client.Hello(1, "0.5", []string{"test:foo", "test:unknown", "test:foo"})
+	if len(enabled) != 1 || enabled[0] != "test:foo" {
+		t.Error("Hello negotiated wrong capabilities", enabled)
+	}
+	if !client.HasCapability("test:foo") || client.HasCapability("test:bar") {
+		t.Error("HasCapability is incorrect")
+	}
+	if client.ProtocolVersion() != 1 || client.ClientVersion() != "0.5" {
+		t.Error("Hello info is not recorded", client.ProtocolVersion(), client.ClientVersion())
+	}
+}
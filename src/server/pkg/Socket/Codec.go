@@ -0,0 +1,115 @@
+package Socket
+
+import (
+	"errors"
+	"github.com/golang/snappy"
+	"server/pkg/Common"
+	"sync"
+)
+
+// Codec field lives in bits 3-5 of pack header. Legacy clients always leave
+// them 0, which is zlib, so nothing changes for them. Uncompressed packs are
+// marked by compression bit only, codec field is ignored then.
+const (
+	CODEC_ZLIB   = iota // 0
+	CODEC_SNAPPY = iota // 1
+
+	CODEC_SHIFT = 3
+	CODEC_MASK  = 0x7
+
+	// packs smaller than this are not worth compressing
+	MIN_COMPRESS_SIZE = 128
+)
+
+const (
+	CAPABILITY_CODEC_SNAPPY = "codec:snappy"
+	CAPABILITY_CODEC_NONE   = "codec:none"
+)
+
+var ErrUnknownCodec = errors.New("unknown codec in pack header")
+
+// Uncompress should fail with ErrPackTooLarge rather than produce more than
+// limit bytes, unless limit <= 0.
+type Codec interface {
+	Compress(data []byte) ([]byte, error)
+	Uncompress(data []byte, limit int) ([]byte, error)
+}
+
+type zlibCodec struct{}
+
+func (zlibCodec) Compress(data []byte) ([]byte, error) {
+	return Common.QCompress(data)
+}
+
+func (zlibCodec) Uncompress(data []byte, limit int) ([]byte, error) {
+	result, err := Common.QUncompressLimit(data, limit)
+	if err == Common.ErrUncompressedTooLarge {
+		return result, ErrPackTooLarge
+	}
+	return result, err
+}
+
+type snappyCodec struct{}
+
+func (snappyCodec) Compress(data []byte) ([]byte, error) {
+	return snappy.Encode(nil, data), nil
+}
+
+func (snappyCodec) Uncompress(data []byte, limit int) ([]byte, error) {
+	length, err := snappy.DecodedLen(data)
+	if err != nil {
+		return nil, err
+	}
+	if limit > 0 && length > limit {
+		return nil, ErrPackTooLarge
+	}
+	return snappy.Decode(nil, data)
+}
+
+var codecs = struct {
+	table  [CODEC_MASK + 1]Codec
+	locker sync.RWMutex
+}{}
+
+func init() {
+	RegisterCodec(CODEC_ZLIB, zlibCodec{})
+	RegisterCodec(CODEC_SNAPPY, snappyCodec{})
+	RegisterCapability(CAPABILITY_CODEC_SNAPPY)
+	RegisterCapability(CAPABILITY_CODEC_NONE)
+}
+
+func RegisterCodec(id int, codec Codec) {
+	codecs.locker.Lock()
+	defer codecs.locker.Unlock()
+	codecs.table[id&CODEC_MASK] = codec
+}
+
+func findCodec(id int) (Codec, error) {
+	codecs.locker.RLock()
+	defer codecs.locker.RUnlock()
+	var codec = codecs.table[id&CODEC_MASK]
+	if codec == nil {
+		return nil, ErrUnknownCodec
+	}
+	return codec, nil
+}
+
+// HeaderFor picks pack header for data sent to this client. Clients get zlib
+// unless they say they know better in hello.
+func (c *SocketClient) HeaderFor(packType int, size int) PackHeader {
+	if size < MIN_COMPRESS_SIZE && c.HasCapability(CAPABILITY_CODEC_NONE) {
+		return PackHeader{
+			Compress: false,
+			PackType: packType,
+		}
+	}
+	var codec = CODEC_ZLIB
+	if c.HasCapability(CAPABILITY_CODEC_SNAPPY) {
+		codec = CODEC_SNAPPY
+	}
+	return PackHeader{
+		Compress: true,
+		PackType: packType,
+		Codec:    codec,
+	}
+}
@@ -0,0 +1,60 @@
+package Socket
+
+import "testing"
+import "bytes"
+
+var longSource = bytes.Repeat([]byte(`{"action":"block"}`), 20)
+
+func TestSnappyPack(t *testing.T) {
+	var header = PackHeader{
+		Compress: true,
+		PackType: DATA,
+		Codec:    CODEC_SNAPPY,
+	}
+	result, err := bufferToPack(longSource, header)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result[0] != 0x0D {
+		t.Error("codec bits are incorrect", result[0])
+	}
+
+	pkg, err := DecodeFrame(protocolPack(result))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Compare(pkg.Unpacked, longSource) != 0 {
+		t.Error("snappy pack is not decoded correctly", pkg.Unpacked)
+	}
+	// recorded packs should always be zlib
+	var legacy = AssamblePack(PackHeader{Compress: true, PackType: DATA}, longSource)
+	if bytes.Compare(pkg.Repacked, legacy) != 0 {
+		t.Error("snappy pack is not repacked into zlib", pkg.Repacked)
+	}
+}
+
+func TestUnknownCodec(t *testing.T) {
+	var data = protocolPack([]byte{0x01 | byte(7<<CODEC_SHIFT), 1, 2, 3})
+	if _, err := DecodeFrame(data); err != ErrUnknownCodec {
+		t.Error("unknown codec should be rejected", err)
+	}
+}
+
+func TestHeaderFor(t *testing.T) {
+	var legacy = SocketClient{}
+	var header = legacy.HeaderFor(DATA, 10)
+	if !header.Compress || header.Codec != CODEC_ZLIB {
+		t.Error("legacy clients should always get zlib", header)
+	}
+
+	var modern = SocketClient{}
+	modern.Hello(PROTOCOL_VERSION, "", []string{CAPABILITY_CODEC_SNAPPY, CAPABILITY_CODEC_NONE})
+	header = modern.HeaderFor(DATA, 10)
+	if header.Compress {
+		t.Error("tiny packs should not be compressed", header)
+	}
+	header = modern.HeaderFor(DATA, MIN_COMPRESS_SIZE)
+	if !header.Compress || header.Codec != CODEC_SNAPPY {
+		t.Error("snappy should be used if negotiated", header)
+	}
+}
@@ -0,0 +1,50 @@
+package Socket
+
+import (
+	"errors"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	DEFAULT_MAX_PACK_SIZE         = 2 * 1024 * 1024  // 2MB, as docs/formats.md says
+	DEFAULT_MAX_UNCOMPRESSED_SIZE = 16 * 1024 * 1024 // 16MB
+	DEFAULT_READ_TIMEOUT          = 120 * time.Second
+	DEFAULT_WRITE_TIMEOUT         = 60 * time.Second
+)
+
+var ErrPackTooLarge = errors.New("pack exceeds size limit")
+
+// SocketLimits protects server from bad or slow peers. Zero for any field
+// means no limit.
+type SocketLimits struct {
+	MaxPackSize         int
+	MaxUncompressedSize int
+	ReadTimeout         time.Duration // longest time to wait for a whole pack
+	WriteTimeout        time.Duration
+}
+
+var limits atomic.Value
+
+func init() {
+	SetLimits(DefaultLimits())
+}
+
+func DefaultLimits() SocketLimits {
+	return SocketLimits{
+		MaxPackSize:         DEFAULT_MAX_PACK_SIZE,
+		MaxUncompressedSize: DEFAULT_MAX_UNCOMPRESSED_SIZE,
+		ReadTimeout:         DEFAULT_READ_TIMEOUT,
+		WriteTimeout:        DEFAULT_WRITE_TIMEOUT,
+	}
+}
+
+// SetLimits applies to every connection from now on, connections already
+// established included.
+func SetLimits(l SocketLimits) {
+	limits.Store(l)
+}
+
+func Limits() SocketLimits {
+	return limits.Load().(SocketLimits)
+}
@@ -0,0 +1,92 @@
+package Socket
+
+import (
+	"crypto/tls"
+	"net"
+	"strconv"
+	"sync"
+)
+
+// ListenTCP listens on the given port, or a random one if port is 0.
+// The port actually used is returned.
+func ListenTCP(port uint16) (net.Listener, uint16, error) {
+	addr, err := net.ResolveTCPAddr("tcp", ":"+strconv.FormatInt(int64(port), 10))
+	if err != nil {
+		return nil, 0, err
+	}
+	ln, err := net.ListenTCP("tcp", addr)
+	if err != nil {
+		return nil, 0, err
+	}
+	realPort, err := listenerPort(ln)
+	if err != nil {
+		ln.Close()
+		return nil, 0, err
+	}
+	return ln, realPort, nil
+}
+
+// ListenWebSocket is ListenTCP, but every connection accepted has to pass
+// WebSocket handshake first.
+func ListenWebSocket(port uint16) (net.Listener, uint16, error) {
+	ln, realPort, err := ListenTCP(port)
+	if err != nil {
+		return nil, 0, err
+	}
+	return NewWebSocketListener(ln), realPort, nil
+}
+
+func listenerPort(ln net.Listener) (uint16, error) {
+	_, port, err := net.SplitHostPort(ln.Addr().String())
+	if err != nil {
+		return 0, err
+	}
+	uport, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return 0, err
+	}
+	return uint16(uport), nil
+}
+
+// ListenTLS is ListenTCP with TLS on top of it.
+func ListenTLS(port uint16, config *tls.Config) (net.Listener, uint16, error) {
+	ln, realPort, err := ListenTCP(port)
+	if err != nil {
+		return nil, 0, err
+	}
+	return tls.NewListener(ln, config), realPort, nil
+}
+
+var tlsConfigCache struct {
+	certFile string
+	keyFile  string
+	config   *tls.Config
+	locker   sync.Mutex
+}
+
+// LoadTLSConfig loads certificate and key, and caches the result until paths
+// change. It returns nil with no error if either path is empty, which means
+// TLS is disabled.
+func LoadTLSConfig(certFile, keyFile string) (*tls.Config, error) {
+	if len(certFile) <= 0 || len(keyFile) <= 0 {
+		return nil, nil
+	}
+	tlsConfigCache.locker.Lock()
+	defer tlsConfigCache.locker.Unlock()
+	if tlsConfigCache.config != nil &&
+		tlsConfigCache.certFile == certFile &&
+		tlsConfigCache.keyFile == keyFile {
+		return tlsConfigCache.config, nil
+	}
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	tlsConfigCache.certFile = certFile
+	tlsConfigCache.keyFile = keyFile
+	tlsConfigCache.config = &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+	return tlsConfigCache.config, nil
+}
@@ -0,0 +1,94 @@
+package Socket
+
+import "testing"
+import "crypto/ecdsa"
+import "crypto/elliptic"
+import "crypto/rand"
+import "crypto/tls"
+import "crypto/x509"
+import "crypto/x509/pkix"
+import "encoding/pem"
+import "math/big"
+import "os"
+import "path/filepath"
+import "strconv"
+import "time"
+
+func writeSelfSignedCert(t *testing.T, dir string) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var template = x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		DNSNames:     []string{"localhost"},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var certFile = filepath.Join(dir, "cert.pem")
+	var keyFile = filepath.Join(dir, "key.pem")
+	os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600)
+	return certFile, keyFile
+}
+
+func TestLoadTLSConfigDisabled(t *testing.T) {
+	config, err := LoadTLSConfig("", "")
+	if config != nil || err != nil {
+		t.Error("empty paths should disable TLS", config, err)
+	}
+}
+
+func TestListenTLS(t *testing.T) {
+	var certFile, keyFile = writeSelfSignedCert(t, t.TempDir())
+	config, err := LoadTLSConfig(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cached, _ := LoadTLSConfig(certFile, keyFile)
+	if cached != config {
+		t.Error("TLS config should be cached")
+	}
+
+	ln, port, err := ListenTLS(0, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	go func() {
+		conn, err := tls.Dial("tcp", "127.0.0.1:"+strconv.Itoa(int(port)),
+			&tls.Config{InsecureSkipVerify: true})
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		conn.Write(AssamblePack(PackHeader{Compress: true, PackType: MANAGER}, []byte(`{"request":"roomlist"}`)))
+		time.Sleep(time.Second)
+	}()
+
+	conn, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var client = MakeSocketClient(conn)
+	defer client.Close()
+
+	select {
+	case pkg := <-client.GetPackageChan():
+		if pkg.PackageType != MANAGER || string(pkg.Unpacked) != `{"request":"roomlist"}` {
+			t.Error("unexpected package", pkg)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no package received")
+	}
+}
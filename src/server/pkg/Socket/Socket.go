@@ -1,5 +1,7 @@
 package Socket
 
+import "crypto/tls"
+import "io"
 import "net"
 import "time"
 import "log"
@@ -7,14 +9,18 @@ import "sync"
 
 type SocketCloseCallback func()
 
+const DISPATCH_QUEUE_SIZE = 64 // frames read but not dispatched yet
+
 type SocketClient struct {
-	readLock              sync.Mutex
 	writeLock             sync.Mutex
-	con                   *net.TCPConn
+	con                   net.Conn
 	closeFlag             sync.Once
+	closing               chan bool
+	frames                chan []byte
 	packageChan           chan Package
 	closeCallbackList     []SocketCloseCallback
 	closeCallbackListLock sync.Mutex
+	hello                 helloInfo
 }
 
 func (c *SocketClient) RegisterCloseCallback(callback SocketCloseCallback) {
@@ -30,8 +36,14 @@ func (c *SocketClient) GetPackageChan() <-chan Package {
 func (c *SocketClient) WriteRaw(data []byte) (int, error) {
 	c.writeLock.Lock()
 	defer c.writeLock.Unlock()
-	// c.con.SetWriteDeadline(<-time.After(60 * time.Second))
-	return c.con.Write(data)
+	if timeout := Limits().WriteTimeout; timeout > 0 {
+		c.con.SetWriteDeadline(time.Now().Add(timeout))
+	}
+	n, err := c.con.Write(data)
+	if err != nil {
+		c.logCloseReason(err)
+	}
+	return n, err
 }
 
 func (c *SocketClient) sendPack(data []byte) (int, error) {
@@ -39,10 +51,7 @@ func (c *SocketClient) sendPack(data []byte) (int, error) {
 }
 
 func (c *SocketClient) SendDataPack(data []byte) (int, error) {
-	var header PackHeader = PackHeader{
-		true,
-		DATA,
-	}
+	var header = c.HeaderFor(DATA, len(data))
 	var result, err = bufferToPack(data, header)
 	if err != nil {
 		return 0, err
@@ -51,10 +60,7 @@ func (c *SocketClient) SendDataPack(data []byte) (int, error) {
 }
 
 func (c *SocketClient) SendMessagePack(data []byte) (int, error) {
-	var header PackHeader = PackHeader{
-		true,
-		MESSAGE,
-	}
+	var header = c.HeaderFor(MESSAGE, len(data))
 	var result, err = bufferToPack(data, header)
 	if err != nil {
 		return 0, err
@@ -63,10 +69,7 @@ func (c *SocketClient) SendMessagePack(data []byte) (int, error) {
 }
 
 func (c *SocketClient) SendCommandPack(data []byte) (int, error) {
-	var header PackHeader = PackHeader{
-		true,
-		COMMAND,
-	}
+	var header = c.HeaderFor(COMMAND, len(data))
 	var result, err = bufferToPack(data, header)
 	if err != nil {
 		return 0, err
@@ -75,10 +78,7 @@ func (c *SocketClient) SendCommandPack(data []byte) (int, error) {
 }
 
 func (c *SocketClient) SendManagerPack(data []byte) (int, error) {
-	var header PackHeader = PackHeader{
-		true,
-		MANAGER,
-	}
+	var header = c.HeaderFor(MANAGER, len(data))
 	var result, err = bufferToPack(data, header)
 	if err != nil {
 		return 0, err
@@ -96,8 +96,8 @@ func AssamblePack(header PackHeader, data []byte) []byte {
 
 func (c *SocketClient) Close() {
 	c.closeFlag.Do(func() {
+		close(c.closing)
 		c.con.Close()
-		close(c.packageChan)
 		c.closeCallbackListLock.Lock()
 		defer c.closeCallbackListLock.Unlock()
 		for i := 0; i < len(c.closeCallbackList); i++ {
@@ -107,52 +107,97 @@ func (c *SocketClient) Close() {
 	})
 }
 
-func (c *SocketClient) RunReadLoop(reader *SocketReader) {
-	reader.RegisterHandler(func(pkg Package) {
-		defer func() {
-			if x := recover(); x != nil {
-				log.Printf("recovered panic: %v", x)
-			}
-		}()
-		c.packageChan <- pkg
-	})
+// logCloseReason logs why connection is going to close, except for the
+// usual reasons, like peer closed it or we closed it.
+func (c *SocketClient) logCloseReason(err error) {
+	select {
+	case _, _ = <-c.closing:
+		return
+	default:
+	}
+	if err == io.EOF {
+		return
+	}
+	if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+		log.Println("closing connection", c.con.RemoteAddr(), "timeout:", err)
+		return
+	}
+	log.Println("closing connection", c.con.RemoteAddr(), "reason:", err)
+}
+
+// readLoop only cuts frames out of connection. Once dispatch queue is full,
+// it stops reading, and TCP flow control slows down the other side.
+func (c *SocketClient) readLoop(reader *SocketReader) {
+	defer close(c.frames)
 	for {
-		buffer := make([]byte, 128)
-		c.readLock.Lock()
-		// c.con.SetReadDeadline(<-time.After(60 * time.Second))
-		outBytes, err := c.con.Read(buffer)
-		c.readLock.Unlock()
+		if timeout := Limits().ReadTimeout; timeout > 0 {
+			c.con.SetReadDeadline(time.Now().Add(timeout))
+		} else {
+			c.con.SetReadDeadline(time.Time{})
+		}
+		frame, err := reader.ReadFrame()
 		if err != nil {
-			reader.UnregisterHandler()
+			c.logCloseReason(err)
 			c.Close()
-			break
+			return
 		}
-		if outBytes == 0 {
-			time.Sleep(1 * time.Second)
-			continue
+		select {
+		case c.frames <- frame:
+		case _, _ = <-c.closing:
+			return
 		}
-		err = reader.OnData(buffer[0:outBytes])
+	}
+}
+
+// dispatchLoop decodes frames and hands them out one by one, so packages
+// always reach packageChan in the order they're sent.
+func (c *SocketClient) dispatchLoop() {
+	defer close(c.packageChan)
+	for frame := range c.frames {
+		pkg, err := DecodeFrame(frame)
 		if err != nil {
-			log.Println(err)
-			reader.UnregisterHandler()
+			c.logCloseReason(err)
 			c.Close()
-			break
+			continue
 		}
+		select {
+		case c.packageChan <- pkg:
+		case _, _ = <-c.closing:
+		}
+	}
+}
+
+func setupTCPConn(con net.Conn) {
+	if wsCon, ok := con.(*WebSocketConn); ok {
+		con = wsCon.Conn
+	}
+	if tlsCon, ok := con.(*tls.Conn); ok {
+		con = tlsCon.NetConn()
+	}
+	tcpCon, ok := con.(*net.TCPConn)
+	if !ok {
+		return
 	}
+	tcpCon.SetKeepAlive(true)
+	tcpCon.SetNoDelay(true)
+	tcpCon.SetLinger(10)
 }
 
-func MakeSocketClient(con *net.TCPConn) *SocketClient {
+// MakeSocketClient accepts any stream connection, raw TCP, TLS and WebSocket
+// connections are treated the same way above this point.
+func MakeSocketClient(con net.Conn) *SocketClient {
 	client := SocketClient{
 		con:         con,
 		closeFlag:   sync.Once{},
+		closing:     make(chan bool),
+		frames:      make(chan []byte, DISPATCH_QUEUE_SIZE),
 		packageChan: make(chan Package),
 	}
-	reader := NewSocketReader()
+	reader := NewSocketReader(con)
 
-	con.SetKeepAlive(true)
-	con.SetNoDelay(true)
-	con.SetLinger(10)
+	setupTCPConn(con)
 
-	go client.RunReadLoop(reader)
+	go client.readLoop(reader)
+	go client.dispatchLoop()
 	return &client
 }
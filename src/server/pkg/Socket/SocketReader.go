@@ -1,9 +1,17 @@
 package Socket
 
-import "server/pkg/Common"
-import "sync"
+import (
+	"bufio"
+	"errors"
+	"io"
+)
 
-type SocketReaderHandler func(pack Package)
+const (
+	READ_BUFFER_SIZE = 32 * 1024
+	SIZE_HEADER_LEN  = 4
+)
+
+var ErrEmptyPack = errors.New("pack without pack header")
 
 type Package struct {
 	PackageType int
@@ -11,103 +19,94 @@ type Package struct {
 	Repacked    []byte
 }
 
+// SocketReader cuts a byte stream into frames. A frame is a whole pack as it
+// is on wire, size header included, so it can be recorded or broadcasted
+// without being packed again.
 type SocketReader struct {
-	buffer      []byte
-	dataSize    int
-	PackageChan chan Package
-	closeFlag   sync.Once
-	handler     SocketReaderHandler
+	reader *bufio.Reader
 }
 
-func NewSocketReader() *SocketReader {
-	reader := &SocketReader{
-		buffer:      make([]byte, 0),
-		dataSize:    0,
-		PackageChan: make(chan Package),
-		handler:     func(_ Package) {},
+func NewSocketReader(r io.Reader) *SocketReader {
+	return &SocketReader{
+		reader: bufio.NewReaderSize(r, READ_BUFFER_SIZE),
 	}
-	return reader
-}
-
-func (r *SocketReader) Close() {
-	r.closeFlag.Do(func() {
-		close(r.PackageChan)
-		r.buffer = make([]byte, 0)
-		r.handler = func(_ Package) {}
-	})
 }
 
-func (r *SocketReader) RegisterHandler(handler SocketReaderHandler) {
-	r.handler = handler
+// ReadFrame blocks until a whole frame arrives. Each frame is read into its
+// own buffer, which is never touched by reader again.
+func (r *SocketReader) ReadFrame() ([]byte, error) {
+	var sizeHeader [SIZE_HEADER_LEN]byte
+	if _, err := io.ReadFull(r.reader, sizeHeader[:]); err != nil {
+		return nil, err
+	}
+	var size = int(sizeHeader[0])<<24 + int(sizeHeader[1])<<16 + int(sizeHeader[2])<<8 + int(sizeHeader[3])
+	if size == 0 {
+		return nil, ErrEmptyPack
+	}
+	if maxSize := Limits().MaxPackSize; maxSize > 0 && size > maxSize {
+		return nil, ErrPackTooLarge
+	}
+	var frame = make([]byte, SIZE_HEADER_LEN+size)
+	copy(frame, sizeHeader[:])
+	if _, err := io.ReadFull(r.reader, frame[SIZE_HEADER_LEN:]); err != nil {
+		return nil, err
+	}
+	return frame, nil
 }
 
-func (r *SocketReader) UnregisterHandler() {
-	r.handler = func(_ Package) {}
+func parsePackHeader(bits byte) PackHeader {
+	return PackHeader{
+		Compress: (bits & 0x1) == 0x1,
+		PackType: int((bits >> 0x1) & MASK),
+		Codec:    int((bits >> CODEC_SHIFT) & CODEC_MASK),
+	}
 }
 
-func (r *SocketReader) OnData(chunk []byte) (err error) {
-	err = nil
-	r.buffer = append(r.buffer, chunk...)
-
-	var GET_PACKAGE_SIZE_FROM_DATA = func() int {
-		var pg_size_array = r.buffer[0:4]
-		r.buffer = r.buffer[4:]
-		var pg_size = int(pg_size_array[0])<<24 + int(pg_size_array[1])<<16 + int(pg_size_array[2])<<8 + int(pg_size_array[3])
-		return pg_size
+// DecodeFrame unpacks a frame read by ReadFrame. Repacked of the result is
+// the frame itself, unless it has to be re-compressed for legacy clients.
+func DecodeFrame(frame []byte) (Package, error) {
+	if len(frame) <= SIZE_HEADER_LEN {
+		return Package{}, ErrEmptyPack
 	}
-
-	var READ_RAW_BYTES = func(size int) []byte {
-		var data = r.buffer[0:size]
-		r.buffer = r.buffer[size:]
-		return data
+	var header = parsePackHeader(frame[SIZE_HEADER_LEN])
+	var dataBlock = frame[SIZE_HEADER_LEN+1:] // dataBlock has no header
+	if !header.Compress {
+		var repacked = frame
+		if header.PackType == DATA || header.PackType == MESSAGE {
+			// packs may be recorded or broadcasted, keep them readable for legacy clients
+			repacked = AssamblePack(PackHeader{
+				Compress: true,
+				PackType: header.PackType,
+				Codec:    CODEC_ZLIB,
+			}, dataBlock)
+		}
+		return Package{
+			PackageType: header.PackType,
+			Unpacked:    dataBlock,
+			Repacked:    repacked,
+		}, nil
 	}
 
-	var REBUILD = func(rawData []byte) []byte {
-		return protocolPack(rawData)
+	codec, err := findCodec(header.Codec)
+	if err != nil {
+		return Package{}, err
 	}
-
-	var GET_FLAG = func(pkgData []byte) PackHeader {
-		var header PackHeader
-		header.Compress = (pkgData[0] & 0x1) == 0x1
-		header.PackType = int((pkgData[0] >> 0x1) & MASK)
-		return header
+	uncompressed_data, err := codec.Uncompress(dataBlock, Limits().MaxUncompressedSize)
+	if err != nil {
+		return Package{}, err
 	}
-
-	for {
-		if r.dataSize == 0 {
-			if len(r.buffer) < 4 {
-				break
-			}
-			r.dataSize = GET_PACKAGE_SIZE_FROM_DATA()
-		}
-		if len(r.buffer) < r.dataSize {
-			break
-		}
-		var packageData = READ_RAW_BYTES(r.dataSize) // raw single package
-		var p_header = GET_FLAG(packageData)         // 8bits header
-		var dataBlock = packageData[1:]              // dataBlock has no header
-		var repacked = REBUILD(packageData)          // repacked, should be equal with packageData
-		if p_header.Compress {
-			uncompressed_data, err := Common.QUncompress(dataBlock)
-			if err != nil {
-				return err
-			}
-			var p = Package{
-				p_header.PackType,
-				uncompressed_data,
-				repacked,
-			}
-			go r.handler(p)
-		} else {
-			var p = Package{
-				p_header.PackType,
-				dataBlock,
-				repacked,
-			}
-			go r.handler(p)
-		}
-
-		r.dataSize = 0
+	var repacked = frame
+	if header.Codec != CODEC_ZLIB {
+		// packs may be recorded or broadcasted, keep them readable for legacy clients
+		repacked = AssamblePack(PackHeader{
+			Compress: true,
+			PackType: header.PackType,
+			Codec:    CODEC_ZLIB,
+		}, uncompressed_data)
 	}
-	return err
+	return Package{
+		PackageType: header.PackType,
+		Unpacked:    uncompressed_data,
+		Repacked:    repacked,
+	}, nil
 }
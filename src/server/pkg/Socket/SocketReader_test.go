@@ -0,0 +1,131 @@
+package Socket
+
+import "testing"
+import "bytes"
+import "net"
+import "strconv"
+import "testing/iotest"
+import "time"
+
+func TestReadFrame(t *testing.T) {
+	var stream bytes.Buffer
+	var first = AssamblePack(PackHeader{Compress: true, PackType: DATA}, []byte(`{"action":"block"}`))
+	var second = protocolPack([]byte{byte(MESSAGE << 1), '{', '}'})
+	stream.Write(first)
+	stream.Write(second)
+
+	var reader = NewSocketReader(iotest.OneByteReader(&stream))
+	frame, err := reader.ReadFrame()
+	if err != nil || bytes.Compare(frame, first) != 0 {
+		t.Error("first frame is incorrect", frame, err)
+	}
+	frame, err = reader.ReadFrame()
+	if err != nil || bytes.Compare(frame, second) != 0 {
+		t.Error("second frame is incorrect", frame, err)
+	}
+
+	pkg, err := DecodeFrame(frame)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pkg.PackageType != MESSAGE || string(pkg.Unpacked) != "{}" {
+		t.Error("uncompressed frame is not decoded correctly", pkg)
+	}
+	// messages are broadcasted, so they're compressed for legacy clients
+	var legacy = AssamblePack(PackHeader{Compress: true, PackType: MESSAGE}, []byte("{}"))
+	if bytes.Compare(pkg.Repacked, legacy) != 0 {
+		t.Error("uncompressed message is not repacked into zlib", pkg.Repacked)
+	}
+
+	if _, err = reader.ReadFrame(); err == nil {
+		t.Error("ReadFrame should fail at end of stream")
+	}
+}
+
+func TestReadEmptyFrame(t *testing.T) {
+	var reader = NewSocketReader(bytes.NewReader([]byte{0, 0, 0, 0}))
+	if _, err := reader.ReadFrame(); err != ErrEmptyPack {
+		t.Error("empty pack should be rejected", err)
+	}
+}
+
+func TestPackageOrder(t *testing.T) {
+	serverConn, clientConn := net.Pipe()
+	var client = MakeSocketClient(serverConn)
+	defer client.Close()
+
+	const count = 500
+	go func() {
+		for i := 0; i < count; i++ {
+			clientConn.Write(AssamblePack(PackHeader{Compress: true, PackType: DATA},
+				[]byte(strconv.Itoa(i))))
+		}
+	}()
+
+	for i := 0; i < count; i++ {
+		select {
+		case pkg := <-client.GetPackageChan():
+			if string(pkg.Unpacked) != strconv.Itoa(i) {
+				t.Fatal("package out of order", i, string(pkg.Unpacked))
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("package missing", i)
+		}
+	}
+
+	clientConn.Close()
+	select {
+	case _, ok := <-client.GetPackageChan():
+		if ok {
+			t.Error("package chan should be closed after connection closed")
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("package chan is not closed")
+	}
+}
+
+func TestPackSizeLimit(t *testing.T) {
+	var origin = Limits()
+	defer SetLimits(origin)
+	var limits = origin
+	limits.MaxPackSize = 16
+	limits.MaxUncompressedSize = 64
+	SetLimits(limits)
+
+	var reader = NewSocketReader(bytes.NewReader(protocolPack(make([]byte, 17))))
+	if _, err := reader.ReadFrame(); err != ErrPackTooLarge {
+		t.Error("pack beyond size limit should be rejected", err)
+	}
+
+	var bomb = AssamblePack(PackHeader{Compress: true, PackType: DATA}, make([]byte, 65))
+	if _, err := DecodeFrame(bomb); err != ErrPackTooLarge {
+		t.Error("uncompressed data beyond limit should be rejected", err)
+	}
+	var snappyBomb = AssamblePack(PackHeader{Compress: true, PackType: DATA, Codec: CODEC_SNAPPY}, make([]byte, 65))
+	if _, err := DecodeFrame(snappyBomb); err != ErrPackTooLarge {
+		t.Error("uncompressed data beyond limit should be rejected", err)
+	}
+}
+
+func TestReadTimeout(t *testing.T) {
+	var origin = Limits()
+	defer SetLimits(origin)
+	var limits = origin
+	limits.ReadTimeout = 100 * time.Millisecond
+	SetLimits(limits)
+
+	serverConn, clientConn := net.Pipe()
+	defer clientConn.Close()
+	var client = MakeSocketClient(serverConn)
+	// half a pack, and nothing more
+	go clientConn.Write([]byte{0, 0, 0, 10, 1})
+
+	select {
+	case _, ok := <-client.GetPackageChan():
+		if ok {
+			t.Error("no package should be received")
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("slow connection is not closed")
+	}
+}
@@ -1,6 +1,5 @@
 package Socket
 
-import "server/pkg/Common"
 import "bytes"
 
 const ( // iota is reset to 0
@@ -14,6 +13,7 @@ const ( // iota is reset to 0
 type PackHeader struct {
 	Compress bool
 	PackType int
+	Codec    int
 }
 
 func protocolPack(data []byte) []byte {
@@ -38,8 +38,11 @@ func bufferToPack(data []byte, header PackHeader) ([]byte, error) {
 	var converted []byte
 	// compress if it requires
 	if header.Compress {
-		var err error
-		converted, err = Common.QCompress(data)
+		codec, err := findCodec(header.Codec)
+		if err != nil {
+			return []byte{}, err
+		}
+		converted, err = codec.Compress(data)
 		if err != nil {
 			return []byte{}, err
 		}
@@ -56,7 +59,11 @@ func bufferToPack(data []byte, header PackHeader) ([]byte, error) {
 		compress_bit = byte(0x0)
 	}
 	var pack_type_bits = byte((header.PackType & MASK) << 0x1)
-	var header_bits = compress_bit | pack_type_bits
+	var codec_bits byte
+	if header.Compress {
+		codec_bits = byte((header.Codec & CODEC_MASK) << CODEC_SHIFT)
+	}
+	var header_bits = compress_bit | pack_type_bits | codec_bits
 	tmpData.WriteByte(header_bits)
 	tmpData.Write(converted)
 
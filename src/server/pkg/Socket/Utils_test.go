@@ -15,8 +15,8 @@ func TestProtocolPack(t *testing.T) {
 
 func TestBufferToPack(t *testing.T) {
 	var header = PackHeader{
-		true,
-		DATA,
+		Compress: true,
+		PackType: DATA,
 	}
 	result, err := bufferToPack(source, header)
 	if err != nil {
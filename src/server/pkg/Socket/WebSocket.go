@@ -0,0 +1,308 @@
+package Socket
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// WebSocket transport carries the very same byte stream as a raw TCP
+// connection: size header, pack header and payload. Browsers just can't open
+// a raw socket, so the stream is wrapped into binary frames. Frame boundaries
+// don't have to match pack boundaries, SocketReader glues them anyway.
+
+const (
+	WS_OPCODE_CONTINUATION = 0x0
+	WS_OPCODE_TEXT         = 0x1
+	WS_OPCODE_BINARY       = 0x2
+	WS_OPCODE_CLOSE        = 0x8
+	WS_OPCODE_PING         = 0x9
+	WS_OPCODE_PONG         = 0xA
+
+	WS_HANDSHAKE_TIMEOUT = 10 * time.Second
+	WS_MAX_CONTROL_SIZE  = 125
+	WS_SUBPROTOCOL       = "paintty"
+)
+
+const wsAcceptGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+var ErrWebSocketProtocol = errors.New("websocket protocol error")
+
+// WebSocketListener accepts connections from inner and hands out the ones
+// that finished WebSocket handshake.
+type WebSocketListener struct {
+	inner     net.Listener
+	conns     chan net.Conn
+	done      chan bool
+	closeFlag sync.Once
+}
+
+func NewWebSocketListener(inner net.Listener) *WebSocketListener {
+	var ln = &WebSocketListener{
+		inner: inner,
+		conns: make(chan net.Conn),
+		done:  make(chan bool),
+	}
+	go ln.acceptLoop()
+	return ln
+}
+
+func (l *WebSocketListener) acceptLoop() {
+	for {
+		conn, err := l.inner.Accept()
+		if err != nil {
+			select {
+			case _, _ = <-l.done:
+				return
+			default:
+			}
+			log.Println(err)
+			time.Sleep(100 * time.Millisecond)
+			continue
+		}
+		go l.upgrade(conn)
+	}
+}
+
+func (l *WebSocketListener) upgrade(conn net.Conn) {
+	conn.SetDeadline(time.Now().Add(WS_HANDSHAKE_TIMEOUT))
+	wsConn, err := serverHandshake(conn)
+	if err != nil {
+		log.Println("websocket handshake failed:", conn.RemoteAddr(), err)
+		conn.Close()
+		return
+	}
+	conn.SetDeadline(time.Time{})
+	select {
+	case l.conns <- wsConn:
+	case _, _ = <-l.done:
+		conn.Close()
+	}
+}
+
+func (l *WebSocketListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case _, _ = <-l.done:
+		return nil, errors.New("websocket listener closed")
+	}
+}
+
+func (l *WebSocketListener) Close() error {
+	var err error
+	l.closeFlag.Do(func() {
+		close(l.done)
+		err = l.inner.Close()
+	})
+	return err
+}
+
+func (l *WebSocketListener) Addr() net.Addr {
+	return l.inner.Addr()
+}
+
+func headerContainsToken(header http.Header, key, token string) bool {
+	for _, value := range header[http.CanonicalHeaderKey(key)] {
+		for _, item := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(item), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func computeAcceptKey(key string) string {
+	h := sha1.New()
+	io.WriteString(h, key+wsAcceptGUID)
+	return base64.StdEncoding.EncodeToString(h.Sum(nil))
+}
+
+func serverHandshake(conn net.Conn) (*WebSocketConn, error) {
+	var reader = bufio.NewReader(conn)
+	req, err := http.ReadRequest(reader)
+	if err != nil {
+		return nil, err
+	}
+	if req.Method != "GET" ||
+		!headerContainsToken(req.Header, "Connection", "upgrade") ||
+		!headerContainsToken(req.Header, "Upgrade", "websocket") {
+		io.WriteString(conn, "HTTP/1.1 400 Bad Request\r\nConnection: close\r\n\r\n")
+		return nil, errors.New("not a websocket upgrade request")
+	}
+	if req.Header.Get("Sec-WebSocket-Version") != "13" {
+		io.WriteString(conn, "HTTP/1.1 426 Upgrade Required\r\nSec-WebSocket-Version: 13\r\n\r\n")
+		return nil, errors.New("unsupported websocket version")
+	}
+	var key = req.Header.Get("Sec-WebSocket-Key")
+	if len(key) == 0 {
+		io.WriteString(conn, "HTTP/1.1 400 Bad Request\r\nConnection: close\r\n\r\n")
+		return nil, errors.New("missing Sec-WebSocket-Key")
+	}
+
+	var resp = "HTTP/1.1 101 Switching Protocols\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Sec-WebSocket-Accept: " + computeAcceptKey(key) + "\r\n"
+	if headerContainsToken(req.Header, "Sec-WebSocket-Protocol", WS_SUBPROTOCOL) {
+		resp += "Sec-WebSocket-Protocol: " + WS_SUBPROTOCOL + "\r\n"
+	}
+	resp += "\r\n"
+	if _, err = io.WriteString(conn, resp); err != nil {
+		return nil, err
+	}
+
+	return &WebSocketConn{
+		Conn:   conn,
+		reader: reader,
+	}, nil
+}
+
+// WebSocketConn is a net.Conn that reads payload of binary frames and writes
+// each Write as a single binary frame.
+type WebSocketConn struct {
+	net.Conn
+	reader    *bufio.Reader
+	readLock  sync.Mutex
+	writeLock sync.Mutex
+	remaining uint64
+	mask      [4]byte
+	maskPos   int
+	closeFlag sync.Once
+}
+
+func (c *WebSocketConn) Read(p []byte) (int, error) {
+	c.readLock.Lock()
+	defer c.readLock.Unlock()
+	for c.remaining == 0 {
+		if err := c.nextDataFrame(); err != nil {
+			return 0, err
+		}
+	}
+	if uint64(len(p)) > c.remaining {
+		p = p[:c.remaining]
+	}
+	n, err := c.reader.Read(p)
+	for i := 0; i < n; i++ {
+		p[i] ^= c.mask[c.maskPos&3]
+		c.maskPos++
+	}
+	c.remaining -= uint64(n)
+	return n, err
+}
+
+// nextDataFrame reads frame headers until a data frame shows up, and answers
+// control frames on the way.
+func (c *WebSocketConn) nextDataFrame() error {
+	for {
+		var head [2]byte
+		if _, err := io.ReadFull(c.reader, head[:]); err != nil {
+			return err
+		}
+		var opcode = head[0] & 0x0F
+		var masked = head[1]&0x80 != 0
+		var length = uint64(head[1] & 0x7F)
+		switch length {
+		case 126:
+			var ext [2]byte
+			if _, err := io.ReadFull(c.reader, ext[:]); err != nil {
+				return err
+			}
+			length = uint64(binary.BigEndian.Uint16(ext[:]))
+		case 127:
+			var ext [8]byte
+			if _, err := io.ReadFull(c.reader, ext[:]); err != nil {
+				return err
+			}
+			length = binary.BigEndian.Uint64(ext[:])
+		}
+		// clients must mask every frame they send
+		if !masked {
+			c.writeClose(1002)
+			return ErrWebSocketProtocol
+		}
+		if _, err := io.ReadFull(c.reader, c.mask[:]); err != nil {
+			return err
+		}
+		c.maskPos = 0
+
+		switch opcode {
+		case WS_OPCODE_BINARY, WS_OPCODE_CONTINUATION:
+			c.remaining = length
+			return nil
+		case WS_OPCODE_PING, WS_OPCODE_PONG, WS_OPCODE_CLOSE:
+			if length > WS_MAX_CONTROL_SIZE {
+				c.writeClose(1002)
+				return ErrWebSocketProtocol
+			}
+			var payload = make([]byte, length)
+			if _, err := io.ReadFull(c.reader, payload); err != nil {
+				return err
+			}
+			for i := range payload {
+				payload[i] ^= c.mask[i&3]
+			}
+			if opcode == WS_OPCODE_PING {
+				c.writeFrame(WS_OPCODE_PONG, payload)
+			} else if opcode == WS_OPCODE_CLOSE {
+				c.writeClose(1000)
+				return io.EOF
+			}
+		default:
+			// text frames can't carry binary packs
+			c.writeClose(1003)
+			return ErrWebSocketProtocol
+		}
+	}
+}
+
+func (c *WebSocketConn) writeFrame(opcode byte, payload []byte) (int, error) {
+	var head = make([]byte, 0, 10+len(payload))
+	head = append(head, 0x80|opcode)
+	var length = len(payload)
+	switch {
+	case length < 126:
+		head = append(head, byte(length))
+	case length <= 0xFFFF:
+		head = append(head, 126, byte(length>>8), byte(length))
+	default:
+		head = append(head, 127)
+		var ext [8]byte
+		binary.BigEndian.PutUint64(ext[:], uint64(length))
+		head = append(head, ext[:]...)
+	}
+	head = append(head, payload...)
+
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+	_, err := c.Conn.Write(head)
+	if err != nil {
+		return 0, err
+	}
+	return length, nil
+}
+
+func (c *WebSocketConn) writeClose(code uint16) {
+	c.closeFlag.Do(func() {
+		c.writeFrame(WS_OPCODE_CLOSE, []byte{byte(code >> 8), byte(code)})
+	})
+}
+
+func (c *WebSocketConn) Write(p []byte) (int, error) {
+	return c.writeFrame(WS_OPCODE_BINARY, p)
+}
+
+func (c *WebSocketConn) Close() error {
+	c.writeClose(1000)
+	return c.Conn.Close()
+}
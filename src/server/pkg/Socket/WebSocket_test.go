@@ -0,0 +1,140 @@
+package Socket
+
+import "testing"
+import "bufio"
+import "bytes"
+import "io"
+import "net"
+import "net/http"
+import "strconv"
+import "time"
+
+func TestComputeAcceptKey(t *testing.T) {
+	// sample from RFC 6455
+	var result = computeAcceptKey("dGhlIHNhbXBsZSBub25jZQ==")
+	if result != "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=" {
+		t.Error("computeAcceptKey error", result)
+	}
+}
+
+func maskedFrame(opcode byte, final bool, payload []byte) []byte {
+	var mask = []byte{0x12, 0x34, 0x56, 0x78}
+	var frame bytes.Buffer
+	var first = opcode
+	if final {
+		first |= 0x80
+	}
+	frame.WriteByte(first)
+	frame.WriteByte(0x80 | byte(len(payload)))
+	frame.Write(mask)
+	for i, b := range payload {
+		frame.WriteByte(b ^ mask[i%4])
+	}
+	return frame.Bytes()
+}
+
+func dialWebSocket(t *testing.T, port uint16) (net.Conn, *bufio.Reader) {
+	conn, err := net.Dial("tcp", "127.0.0.1:"+strconv.Itoa(int(port)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.WriteString(conn, "GET / HTTP/1.1\r\n"+
+		"Host: localhost\r\n"+
+		"Upgrade: websocket\r\n"+
+		"Connection: Upgrade\r\n"+
+		"Sec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\n"+
+		"Sec-WebSocket-Version: 13\r\n\r\n")
+	var reader = bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != 101 {
+		t.Fatal("handshake failed", resp.Status)
+	}
+	if resp.Header.Get("Sec-WebSocket-Accept") != "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=" {
+		t.Fatal("handshake accept key error", resp.Header)
+	}
+	return conn, reader
+}
+
+func TestWebSocketPack(t *testing.T) {
+	ln, port, err := ListenWebSocket(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	conn, reader := dialWebSocket(t, port)
+	defer conn.Close()
+
+	serverConn, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var client = MakeSocketClient(serverConn)
+	defer client.Close()
+
+	// one pack split into two frames
+	var pack = AssamblePack(PackHeader{Compress: true, PackType: COMMAND}, []byte(`{"request":"roomlist"}`))
+	conn.Write(maskedFrame(WS_OPCODE_BINARY, false, pack[:3]))
+	conn.Write(maskedFrame(WS_OPCODE_PING, true, []byte("hi")))
+	conn.Write(maskedFrame(WS_OPCODE_CONTINUATION, true, pack[3:]))
+
+	select {
+	case pkg := <-client.GetPackageChan():
+		if pkg.PackageType != COMMAND || string(pkg.Unpacked) != `{"request":"roomlist"}` {
+			t.Error("unexpected package", pkg)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no package received")
+	}
+
+	// pong comes back first
+	var head = make([]byte, 4)
+	if _, err := io.ReadFull(reader, head); err != nil {
+		t.Fatal(err)
+	}
+	if head[0] != 0x80|WS_OPCODE_PONG || head[1] != 2 || string(head[2:]) != "hi" {
+		t.Error("unexpected pong", head)
+	}
+
+	client.SendCommandPack([]byte(`{"response":"roomlist"}`))
+	head = make([]byte, 2)
+	if _, err := io.ReadFull(reader, head); err != nil {
+		t.Fatal(err)
+	}
+	if head[0] != 0x80|WS_OPCODE_BINARY || head[1]&0x80 != 0 {
+		t.Error("unexpected frame header", head)
+	}
+	var payload = make([]byte, head[1])
+	if _, err := io.ReadFull(reader, payload); err != nil {
+		t.Fatal(err)
+	}
+	var expected = AssamblePack(PackHeader{Compress: true, PackType: COMMAND}, []byte(`{"response":"roomlist"}`))
+	if bytes.Compare(payload, expected) != 0 {
+		t.Error("unexpected frame payload", payload, expected)
+	}
+}
+
+func TestWebSocketRejectPlainRequest(t *testing.T) {
+	ln, port, err := ListenWebSocket(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	conn, err := net.Dial("tcp", "127.0.0.1:"+strconv.Itoa(int(port)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	io.WriteString(conn, "GET / HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != 400 {
+		t.Error("plain http request should be rejected", resp.Status)
+	}
+}
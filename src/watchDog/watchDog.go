@@ -1,15 +1,11 @@
 package main
 
 import (
-	"encoding/json"
 	"flag"
 	"log"
-	"net"
 	"os"
+	"server/pkg/Client"
 	"server/pkg/Logger"
-	"server/pkg/RoomManager"
-	"server/pkg/Router"
-	"server/pkg/Socket"
 	"syscall"
 	"time"
 )
@@ -42,63 +38,26 @@ func startProc() *os.Process {
 	return proc
 }
 
-func dial() *Socket.SocketClient {
-	tcpAddr, err := net.ResolveTCPAddr("tcp", "localhost:7777")
-	if err != nil {
-		panic(nil)
-	}
-	conn, err := net.DialTCP("tcp", nil, tcpAddr)
-	if err != nil {
-		panic(err)
-	}
-	return Socket.MakeSocketClient(conn)
-}
-
-func sendMessage(client *Socket.SocketClient) {
-	raw, err := json.Marshal(RoomManager.RoomListRequest{
-		Request: "roomlist",
-	})
+func dial() *Client.ManagerClient {
+	client, err := Client.DialManager("localhost:7777")
 	if err != nil {
 		panic(err)
 	}
-	client.SendManagerPack(raw)
+	return client
 }
 
-func loop(client *Socket.SocketClient) <-chan bool {
-	router := Router.MakeRouter("response")
-	seemsDead := make(chan bool)
+func loop(client *Client.ManagerClient) <-chan bool {
+	seemsDead := make(chan bool, 1)
+	client.Timeout = time.Second * 30
 
-	go func(client *Socket.SocketClient) {
-		clientCloseChan := make(chan bool)
-		client.RegisterCloseCallback(func() {
-			clientCloseChan <- true
-		})
+	go func(client *Client.ManagerClient, dead chan<- bool) {
+		defer client.Close()
 		for {
-			select {
-			case _, _ = <-clientCloseChan:
-				close(clientCloseChan)
-				return
-			case <-time.After(time.Second * 10):
-				sendMessage(client)
-			}
-		}
-	}(client)
-
-	go func(client *Socket.SocketClient, dead chan<- bool) {
-		for {
-			select {
-			case pkg, ok := <-client.GetPackageChan():
-				if !ok {
-					return
-				}
-				if pkg.PackageType == Socket.MANAGER {
-					err := router.OnMessage(pkg.Unpacked, client)
-					if err != nil {
-						client.Close()
-					}
-				}
-			case <-time.After(time.Second * 30):
+			<-time.After(time.Second * 10)
+			if _, err := client.RoomList(); err != nil {
+				log.Println("painttyServer seems dead:", err)
 				dead <- true
+				return
 			}
 		}
 	}(client, seemsDead)